@@ -0,0 +1,454 @@
+// Copyright (C) 2021 Administrator
+//
+// This file is part of backend.
+//
+// backend is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// backend is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with backend.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/kamva/mgm/v3"
+	"github.com/thedevsaddam/govalidator"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	//annotationInternal only seen by staff and the judge who wrote it
+	annotationInternal = "internal"
+	//annotationShared sent to the contestant along with the review decision
+	annotationShared = "shared"
+
+	//maxAnnotationOffset longest video offset accepted, in seconds
+	maxAnnotationOffset = 24 * 60 * 60
+
+	auditTargetAnnotation = "annotation"
+)
+
+//parseOffset read a video offset given as seconds, mm:ss or hh:mm:ss
+func parseOffset(value string) (int, error) {
+	parts := strings.Split(strings.TrimSpace(value), ":")
+	if len(parts) > 3 {
+		return 0, errors.New("too many parts")
+	}
+
+	offset := 0
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return 0, errors.New("not a number")
+		}
+		// minutes and seconds after the first part roll over at 60
+		if i > 0 && n >= 60 {
+			return 0, errors.New("out of range")
+		}
+		offset = offset*60 + n
+	}
+	if offset > maxAnnotationOffset {
+		return 0, errors.New("out of range")
+	}
+
+	return offset, nil
+}
+
+//formatOffset video offset as mm:ss, or h:mm:ss past the first hour
+func formatOffset(offset int) string {
+	if offset >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", offset/3600, offset/60%60, offset%60)
+	}
+	return fmt.Sprintf("%02d:%02d", offset/60, offset%60)
+}
+
+//annotationOffsetError validation error of an offset field
+func annotationOffsetError() url.Values {
+	return url.Values{
+		"offset": []string{"The offset field must be seconds, mm:ss or hh:mm:ss within 24 hours"},
+	}
+}
+
+//findAnnotations annotations matching filter in video order
+func findAnnotations(filter bson.M) ([]Annotation, error) {
+	annotations := []Annotation{}
+	findOptions := &options.FindOptions{}
+	findOptions.SetSort(bson.D{{Key: "offset", Value: 1}, {Key: "created_at", Value: 1}})
+
+	err := mgm.Coll(&Annotation{}).SimpleFind(&annotations, filter, findOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range annotations {
+		annotations[i].Timestamp = formatOffset(annotations[i].Offset)
+	}
+	return annotations, nil
+}
+
+//sendReviewDecision email contestant the outcome of the review with the
+//shared annotations of the judges
+func sendReviewDecision(contestant *Contestant) error {
+	if contestant.Email == "" {
+		return nil
+	}
+
+	annotations, err := findAnnotations(bson.M{
+		"contestantId": contestant.ID,
+		"visibility":   annotationShared,
+	})
+	if err != nil {
+		return err
+	}
+
+	var body strings.Builder
+	fmt.Fprintf(&body, "Hi %s,\n\n", contestant.Name)
+	if contestant.Status == contestantRejected {
+		fmt.Fprintf(&body, "Unfortunately \"%s\" was not accepted into the contest.\n", contestant.Title)
+		fmt.Fprintf(&body, "Reason: %s\n", contestant.StatusReason)
+	} else {
+		fmt.Fprintf(&body, "Congratulations, \"%s\" was accepted into the contest.\n", contestant.Title)
+	}
+	if len(annotations) != 0 {
+		body.WriteString("\nNotes from the judges on your video:\n\n")
+		for _, annotation := range annotations {
+			fmt.Fprintf(&body, "%s  %s\n", annotation.Timestamp, annotation.Text)
+		}
+	}
+
+	go func(to string, body string) {
+		if err := mailer.Send(to, "Your submission was reviewed", body); err != nil {
+			log.Println(err)
+		}
+	}(contestant.Email, body.String())
+
+	return nil
+}
+
+//assignedContestant contestant of the request when it is assigned to the
+//judge, otherwise the response is written and nil returned
+func assignedContestant(rw http.ResponseWriter, r *http.Request, result *HTTPResponse) *Contestant {
+	contestant := &Contestant{}
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err == nil {
+		err = mgm.Coll(contestant).FindByID(id, contestant)
+	}
+	if err != nil {
+		result.ErrorMsg = "Data Not Found"
+
+		rw.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(rw).Encode(result)
+		return nil
+	}
+
+	assignment, err := findAssignment(contestant.ID, adminFromContext(r).Username)
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return nil
+	}
+	if assignment == nil {
+		result.ErrorMsg = "Contestant is not assigned to you"
+
+		rw.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(rw).Encode(result)
+		return nil
+	}
+
+	return contestant
+}
+
+//ownAnnotation annotation of the request when the judge wrote it, otherwise
+//the response is written and nil returned
+func ownAnnotation(rw http.ResponseWriter, r *http.Request, result *HTTPResponse) *Annotation {
+	annotation := &Annotation{}
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err == nil {
+		err = mgm.Coll(annotation).FindByID(id, annotation)
+	}
+	if err != nil || annotation.Author != adminFromContext(r).Username {
+		result.ErrorMsg = "Data Not Found"
+
+		rw.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(rw).Encode(result)
+		return nil
+	}
+
+	return annotation
+}
+
+//createAnnotation leave a note at a moment of the video of a contestant
+func createAnnotation(rw http.ResponseWriter, r *http.Request) {
+	result := &HTTPResponse{}
+
+	mapAnnotation := &struct {
+		Offset     string `json:"offset"`
+		Text       string `json:"text"`
+		Visibility string `json:"visibility"`
+	}{}
+
+	rules := govalidator.MapData{
+		"offset":     []string{"required"},
+		"text":       []string{"required", "between:1,2000"},
+		"visibility": []string{"in:" + annotationInternal + "," + annotationShared},
+	}
+
+	opts := govalidator.Options{
+		Request: r,
+		Data:    mapAnnotation,
+		Rules:   rules,
+	}
+
+	v := govalidator.New(opts)
+	if e := v.ValidateJSON(); len(e) != 0 {
+		result.ValidationError = e
+
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	offset, err := parseOffset(mapAnnotation.Offset)
+	if err != nil {
+		result.ValidationError = annotationOffsetError()
+
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	contestant := assignedContestant(rw, r, result)
+	if contestant == nil {
+		return
+	}
+
+	visibility := mapAnnotation.Visibility
+	if visibility == "" {
+		visibility = annotationInternal
+	}
+
+	annotation := &Annotation{
+		ContestID:    contestant.ContestID,
+		ContestantID: contestant.ID,
+		Author:       adminFromContext(r).Username,
+		Offset:       offset,
+		Text:         mapAnnotation.Text,
+		Visibility:   visibility,
+	}
+
+	err = mgm.Coll(annotation).Create(annotation)
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	annotation.Timestamp = formatOffset(annotation.Offset)
+
+	recordAudit(r, "annotation.create", auditTargetAnnotation, annotation.ID.Hex(), nil, annotation)
+
+	result.Data, err = json.Marshal(annotation)
+	if err != nil {
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	result.Status = true
+
+	json.NewEncoder(rw).Encode(result)
+	return
+}
+
+//getJudgeAnnotations annotations the judge left on a contestant, other
+//judges' notes stay hidden so they do not sway the score
+func getJudgeAnnotations(rw http.ResponseWriter, r *http.Request) {
+	result := &HTTPResponse{}
+
+	contestant := assignedContestant(rw, r, result)
+	if contestant == nil {
+		return
+	}
+
+	annotations, err := findAnnotations(bson.M{
+		"contestantId": contestant.ID,
+		"author":       adminFromContext(r).Username,
+	})
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	result.Data, err = json.Marshal(annotations)
+	if err != nil {
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	result.Status = true
+
+	json.NewEncoder(rw).Encode(result)
+	return
+}
+
+//updateAnnotation change the offset, text or visibility of an annotation
+func updateAnnotation(rw http.ResponseWriter, r *http.Request) {
+	result := &HTTPResponse{}
+
+	mapAnnotation := &struct {
+		Offset     string `json:"offset"`
+		Text       string `json:"text"`
+		Visibility string `json:"visibility"`
+	}{}
+
+	rules := govalidator.MapData{
+		"offset":     []string{},
+		"text":       []string{"between:1,2000"},
+		"visibility": []string{"in:" + annotationInternal + "," + annotationShared},
+	}
+
+	opts := govalidator.Options{
+		Request: r,
+		Data:    mapAnnotation,
+		Rules:   rules,
+	}
+
+	v := govalidator.New(opts)
+	if e := v.ValidateJSON(); len(e) != 0 {
+		result.ValidationError = e
+
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	annotation := ownAnnotation(rw, r, result)
+	if annotation == nil {
+		return
+	}
+	before := *annotation
+
+	if mapAnnotation.Offset != "" {
+		offset, err := parseOffset(mapAnnotation.Offset)
+		if err != nil {
+			result.ValidationError = annotationOffsetError()
+
+			json.NewEncoder(rw).Encode(result)
+			return
+		}
+		annotation.Offset = offset
+	}
+	if mapAnnotation.Text != "" {
+		annotation.Text = mapAnnotation.Text
+	}
+	if mapAnnotation.Visibility != "" {
+		annotation.Visibility = mapAnnotation.Visibility
+	}
+
+	err := mgm.Coll(annotation).Update(annotation)
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	annotation.Timestamp = formatOffset(annotation.Offset)
+
+	recordAudit(r, "annotation.update", auditTargetAnnotation, annotation.ID.Hex(), before, annotation)
+
+	result.Data, err = json.Marshal(annotation)
+	if err != nil {
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	result.Status = true
+
+	json.NewEncoder(rw).Encode(result)
+	return
+}
+
+//deleteAnnotation remove an annotation the judge wrote
+func deleteAnnotation(rw http.ResponseWriter, r *http.Request) {
+	result := &HTTPResponse{}
+
+	annotation := ownAnnotation(rw, r, result)
+	if annotation == nil {
+		return
+	}
+
+	err := mgm.Coll(annotation).Delete(annotation)
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	recordAudit(r, "annotation.delete", auditTargetAnnotation, annotation.ID.Hex(), annotation, nil)
+
+	result.Status = true
+
+	json.NewEncoder(rw).Encode(result)
+	return
+}
+
+//getContestantAnnotations every annotation on a contestant for staff,
+//?visibility=shared lists what the contestant gets with the review decision
+func getContestantAnnotations(rw http.ResponseWriter, r *http.Request) {
+	result := &HTTPResponse{}
+
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		result.ErrorMsg = "Data Not Found"
+
+		rw.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	filter := bson.M{"contestantId": id}
+	if visibility := r.URL.Query().Get("visibility"); visibility != "" {
+		filter["visibility"] = visibility
+	}
+	if author := r.URL.Query().Get("author"); author != "" {
+		filter["author"] = author
+	}
+
+	annotations, err := findAnnotations(filter)
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	result.Data, err = json.Marshal(annotations)
+	if err != nil {
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	result.Status = true
+
+	json.NewEncoder(rw).Encode(result)
+	return
+}
@@ -0,0 +1,321 @@
+// Copyright (C) 2021 Administrator
+//
+// This file is part of backend.
+//
+// backend is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// backend is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with backend.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/kamva/mgm/v3"
+	"github.com/thedevsaddam/govalidator"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	apiKeyPrefix = "m2m_"
+
+	scopeContestantsRead = "contestants:read"
+)
+
+//apiKeyScopes scopes an API key can be granted
+var apiKeyScopes = map[string]string{
+	scopeContestantsRead: "Read contestant list",
+}
+
+//scopedHandler handler that API keys holding Scope may call, every other
+//handler behind VerifyAuthTokenMiddleware only accepts admin sessions
+type scopedHandler struct {
+	Scope   string
+	Handler http.HandlerFunc
+}
+
+func (h scopedHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	h.Handler(rw, r)
+}
+
+//requireScope allow API keys holding scope to call handler
+func requireScope(scope string, handler http.HandlerFunc) http.Handler {
+	return scopedHandler{
+		Scope:   scope,
+		Handler: handler,
+	}
+}
+
+//routeScope scope required by the matched route, empty when API keys are
+//not allowed on it
+func routeScope(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return ""
+	}
+
+	if handler, ok := route.GetHandler().(scopedHandler); ok {
+		return handler.Scope
+	}
+	return ""
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+//generateAPIKey generate a new key, returns the key and its public prefix
+func generateAPIKey() (string, string, error) {
+	b := make([]byte, 28)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+
+	encoded := hex.EncodeToString(b)
+	prefix := encoded[:8]
+
+	return fmt.Sprintf("%s%s_%s", apiKeyPrefix, prefix, encoded[8:]), prefix, nil
+}
+
+func isAPIKey(token string) bool {
+	return strings.HasPrefix(token, apiKeyPrefix)
+}
+
+//HasScope whether the key was granted scope
+func (key *APIKey) HasScope(scope string) bool {
+	for _, s := range key.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+//findAPIKey find a usable key by its plaintext value, returns nil when it is
+//unknown, revoked, expired or its creator lost access
+func findAPIKey(token string) (*APIKey, error) {
+	key := &APIKey{}
+
+	err := mgm.Coll(key).First(bson.M{"hash": hashAPIKey(token)}, key)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if key.RevokedAt != nil || time.Now().After(key.ExpiresAt) {
+		return nil, nil
+	}
+
+	// a key acts for its creator, it stops working once they are deactivated
+	// or no longer staff
+	creator := &Admin{}
+	err = mgm.Coll(creator).First(bson.M{"username": key.CreatedBy}, creator)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	role := creator.EffectiveRole()
+	if !creator.IsActive || (role != adminRoleAdmin && role != adminRoleSuperadmin) {
+		return nil, nil
+	}
+
+	// last use is only written once a minute to spare the database
+	if key.LastUsedAt == nil || time.Since(*key.LastUsedAt) > time.Minute {
+		now := time.Now()
+		key.LastUsedAt = &now
+		_, err = mgm.Coll(key).UpdateOne(
+			mgm.Ctx(),
+			bson.M{"_id": key.ID},
+			bson.M{"$set": bson.M{"lastUsedAt": now}},
+		)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+
+	return key, nil
+}
+
+func createAPIKey(rw http.ResponseWriter, r *http.Request) {
+	result := &HTTPResponse{}
+
+	mapKey := &struct {
+		Name          string   `json:"name"`
+		Scopes        []string `json:"scopes"`
+		ExpiresInDays int      `json:"expiresInDays"`
+	}{}
+
+	rules := govalidator.MapData{
+		"name":          []string{"required", "between:3,64"},
+		"scopes":        []string{"required"},
+		"expiresInDays": []string{"required", "numeric_between:1,365"},
+	}
+
+	opts := govalidator.Options{
+		Request: r,
+		Data:    mapKey,
+		Rules:   rules,
+	}
+
+	v := govalidator.New(opts)
+	if e := v.ValidateJSON(); len(e) != 0 {
+		result.ValidationError = e
+
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	for _, scope := range mapKey.Scopes {
+		if _, ok := apiKeyScopes[scope]; !ok {
+			result.ValidationError = url.Values{
+				"scopes": []string{fmt.Sprintf("The scopes field contains unknown scope %s", scope)},
+			}
+
+			json.NewEncoder(rw).Encode(result)
+			return
+		}
+	}
+
+	token, prefix, err := generateAPIKey()
+	if err != nil {
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	key := &APIKey{
+		Name:      mapKey.Name,
+		Prefix:    prefix,
+		Hash:      hashAPIKey(token),
+		Scopes:    mapKey.Scopes,
+		CreatedBy: adminFromContext(r).Username,
+		ExpiresAt: time.Now().AddDate(0, 0, mapKey.ExpiresInDays),
+	}
+
+	err = mgm.Coll(key).Create(key)
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	recordAudit(r, "api_key.create", auditTargetAPIKey, key.ID.Hex(), nil, key)
+
+	// the plaintext key is only shown here, it can not be recovered later
+	result.Data, err = json.Marshal(map[string]interface{}{
+		"key":    token,
+		"apiKey": key,
+	})
+	if err != nil {
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	result.Status = true
+
+	json.NewEncoder(rw).Encode(result)
+	return
+}
+
+func getAPIKeys(rw http.ResponseWriter, r *http.Request) {
+	result := &HTTPResponse{}
+
+	admin := adminFromContext(r)
+
+	filter := bson.M{}
+	if admin.EffectiveRole() != adminRoleSuperadmin {
+		filter["createdBy"] = admin.Username
+	}
+
+	keys := []APIKey{}
+
+	findOptions := &options.FindOptions{}
+	findOptions.SetSort(bson.M{"created_at": -1})
+
+	err := mgm.Coll(&APIKey{}).SimpleFind(&keys, filter, findOptions)
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	result.Data, err = json.Marshal(keys)
+	if err != nil {
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	result.Status = true
+
+	json.NewEncoder(rw).Encode(result)
+	return
+}
+
+func revokeAPIKey(rw http.ResponseWriter, r *http.Request) {
+	result := &HTTPResponse{}
+
+	admin := adminFromContext(r)
+	key := &APIKey{}
+
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err == nil {
+		err = mgm.Coll(key).FindByID(id, key)
+	}
+	if err != nil || (key.CreatedBy != admin.Username && admin.EffectiveRole() != adminRoleSuperadmin) {
+		result.ErrorMsg = "Data Not Found"
+
+		rw.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	if key.RevokedAt == nil {
+		before := *key
+
+		now := time.Now()
+		key.RevokedAt = &now
+
+		err = mgm.Coll(key).Update(key)
+		if err != nil {
+			log.Println(err)
+			result.ErrorMsg = err.Error()
+			json.NewEncoder(rw).Encode(result)
+			return
+		}
+
+		recordAudit(r, "api_key.revoke", auditTargetAPIKey, key.ID.Hex(), before, key)
+	}
+
+	result.Status = true
+
+	json.NewEncoder(rw).Encode(result)
+	return
+}
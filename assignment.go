@@ -0,0 +1,682 @@
+// Copyright (C) 2021 Administrator
+//
+// This file is part of backend.
+//
+// backend is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// backend is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with backend.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/kamva/mgm/v3"
+	"github.com/thedevsaddam/govalidator"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	assignmentPending = "pending"
+	assignmentDone    = "done"
+
+	auditTargetAssignment = "assignment"
+)
+
+//assignmentPair a contestant the planner hands to a judge
+type assignmentPair struct {
+	ContestantID primitive.ObjectID
+	Judge        string
+}
+
+//planAssignments hand every contestant to perContestant judges on top of
+//existing, always picking the least loaded judge that does not have the
+//contestant yet and is allowed to, maxPerJudge of 0 means no cap and a nil
+//allowed allows every pair. Returns the new pairs and how many slots could
+//not be filled
+func planAssignments(contestants []primitive.ObjectID, judges []string, existing []Assignment, perContestant int, maxPerJudge int, allowed func(contestant primitive.ObjectID, judge string) bool) ([]assignmentPair, int) {
+	load := map[string]int{}
+	for _, judge := range judges {
+		load[judge] = 0
+	}
+
+	assigned := map[primitive.ObjectID]map[string]bool{}
+	for _, contestant := range contestants {
+		assigned[contestant] = map[string]bool{}
+	}
+	for _, assignment := range existing {
+		if _, ok := load[assignment.Judge]; ok {
+			load[assignment.Judge]++
+		}
+		if _, ok := assigned[assignment.ContestantID]; ok {
+			assigned[assignment.ContestantID][assignment.Judge] = true
+		}
+	}
+
+	// the least covered contestants go first so a cap that runs out leaves
+	// the gaps spread instead of starving the last contestants
+	ordered := append([]primitive.ObjectID{}, contestants...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return len(assigned[ordered[i]]) < len(assigned[ordered[j]])
+	})
+
+	sortedJudges := append([]string{}, judges...)
+	sort.Strings(sortedJudges)
+
+	pairs := []assignmentPair{}
+	unfilled := 0
+
+	for _, contestant := range ordered {
+		for need := perContestant - len(assigned[contestant]); need > 0; need-- {
+			best := ""
+			for _, judge := range sortedJudges {
+				if assigned[contestant][judge] {
+					continue
+				}
+				if allowed != nil && !allowed(contestant, judge) {
+					continue
+				}
+				if maxPerJudge > 0 && load[judge] >= maxPerJudge {
+					continue
+				}
+				if best == "" || load[judge] < load[best] {
+					best = judge
+				}
+			}
+			if best == "" {
+				unfilled += need
+				break
+			}
+
+			assigned[contestant][best] = true
+			load[best]++
+			pairs = append(pairs, assignmentPair{ContestantID: contestant, Judge: best})
+		}
+	}
+
+	return pairs, unfilled
+}
+
+//activeJudges active judges, limited to only when it is not empty. Returns
+//the usernames of only that are not active judges
+func activeJudges(only []string) ([]Admin, []string, error) {
+	filter := bson.M{"role": adminRoleJudge, "isActive": true}
+	if len(only) != 0 {
+		filter["username"] = bson.M{"$in": only}
+	}
+
+	admins := []Admin{}
+	err := mgm.Coll(&Admin{}).SimpleFind(&admins, filter)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	found := map[string]bool{}
+	for _, admin := range admins {
+		found[admin.Username] = true
+	}
+
+	unknown := []string{}
+	for _, username := range only {
+		if !found[username] {
+			unknown = append(unknown, username)
+		}
+	}
+
+	return admins, unknown, nil
+}
+
+//judgeLoad number of assignments of every judge in a contest
+func judgeLoad(assignments []Assignment) map[string]map[string]int {
+	load := map[string]map[string]int{}
+	for _, assignment := range assignments {
+		if load[assignment.Judge] == nil {
+			load[assignment.Judge] = map[string]int{
+				assignmentPending: 0,
+				assignmentDone:    0,
+			}
+		}
+		load[assignment.Judge][assignment.Status]++
+	}
+	return load
+}
+
+//ensureAssignmentIndexes create the unique index that hands a contestant to
+//a judge at most once
+func ensureAssignmentIndexes() error {
+	_, err := mgm.Coll(&Assignment{}).Indexes().CreateOne(mgm.Ctx(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "contestantId", Value: 1}, {Key: "judge", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+//findAssignment assignment of contestant to judge, nil when there is none
+func findAssignment(contestantID primitive.ObjectID, judge string) (*Assignment, error) {
+	assignment := &Assignment{}
+
+	err := mgm.Coll(assignment).First(bson.M{"contestantId": contestantID, "judge": judge}, assignment)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return assignment, nil
+}
+
+//runAssignments top up the assignments of a contest, running it again after
+//new submissions only hands out the missing slots
+func runAssignments(rw http.ResponseWriter, r *http.Request) {
+	result := &HTTPResponse{}
+
+	mapRun := &struct {
+		JudgesPerContestant int      `json:"judgesPerContestant"`
+		MaxPerJudge         int      `json:"maxPerJudge"`
+		Judges              []string `json:"judges"`
+	}{}
+
+	rules := govalidator.MapData{
+		"judgesPerContestant": []string{"required", "numeric_between:1,20"},
+		"maxPerJudge":         []string{"numeric_between:0,10000"},
+		"judges":              []string{},
+	}
+
+	opts := govalidator.Options{
+		Request: r,
+		Data:    mapRun,
+		Rules:   rules,
+	}
+
+	v := govalidator.New(opts)
+	if e := v.ValidateJSON(); len(e) != 0 {
+		result.ValidationError = e
+
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	contest := contestFromVars(rw, r, result)
+	if contest == nil {
+		return
+	}
+
+	judges, unknown, err := activeJudges(mapRun.Judges)
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	if len(unknown) != 0 {
+		result.ValidationError = url.Values{
+			"judges": []string{fmt.Sprintf("The judges field contains %v which are not active judges", unknown)},
+		}
+
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	if len(judges) < mapRun.JudgesPerContestant {
+		result.ValidationError = url.Values{
+			"judgesPerContestant": []string{fmt.Sprintf("The judgesPerContestant field can not exceed the %d available judges", len(judges))},
+		}
+
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	contestants := []Contestant{}
+	// unverified, rejected and expired submissions do not count and are not
+	// handed to judges
+	filter := verifiedContestantFilter()
+	filter["contestId"] = contest.ID
+	filter["status"] = judgedContestantFilter()
+	err = mgm.Coll(&Contestant{}).SimpleFind(&contestants, filter)
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	contestantIDs := []primitive.ObjectID{}
+	byID := map[primitive.ObjectID]*Contestant{}
+	for i := range contestants {
+		contestantIDs = append(contestantIDs, contestants[i].ID)
+		byID[contestants[i].ID] = &contestants[i]
+	}
+
+	exceptions, err := conflictExceptions(contest.ID)
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	existing := []Assignment{}
+	err = mgm.Coll(&Assignment{}).SimpleFind(&existing, bson.M{"contestId": contest.ID})
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	usernames := []string{}
+	byUsername := map[string]*Admin{}
+	for i := range judges {
+		usernames = append(usernames, judges[i].Username)
+		byUsername[judges[i].Username] = &judges[i]
+	}
+
+	// a pair is asked about again for every open slot, count it once
+	conflicted := map[conflictPair]bool{}
+	allowed := func(contestantID primitive.ObjectID, judge string) bool {
+		if !hasConflict(byUsername[judge], byID[contestantID]) {
+			return true
+		}
+		if exceptions[conflictPair{ContestantID: contestantID, Judge: judge}] {
+			return true
+		}
+		conflicted[conflictPair{ContestantID: contestantID, Judge: judge}] = true
+		return false
+	}
+
+	pairs, unfilled := planAssignments(contestantIDs, usernames, existing, mapRun.JudgesPerContestant, mapRun.MaxPerJudge, allowed)
+	conflicts := len(conflicted)
+
+	assignedBy := adminFromContext(r).Username
+	created := []Assignment{}
+	for _, pair := range pairs {
+		assignment := &Assignment{
+			ContestID:    contest.ID,
+			ContestantID: pair.ContestantID,
+			Judge:        pair.Judge,
+			Status:       assignmentPending,
+			AssignedBy:   assignedBy,
+		}
+
+		// a concurrent run may have assigned the pair already
+		err = mgm.Coll(assignment).Create(assignment)
+		if isDuplicateKeyError(err) {
+			continue
+		}
+		if err != nil {
+			log.Println(err)
+			result.ErrorMsg = err.Error()
+			json.NewEncoder(rw).Encode(result)
+			return
+		}
+		created = append(created, *assignment)
+	}
+
+	before := *contest
+	contest.Judging = &JudgingSetting{
+		JudgesPerContestant: mapRun.JudgesPerContestant,
+		MaxPerJudge:         mapRun.MaxPerJudge,
+	}
+	err = mgm.Coll(contest).Update(contest)
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	recordAudit(r, "assignment.run", auditTargetContest, contest.ID.Hex(), before, map[string]interface{}{
+		"judging":   contest.Judging,
+		"created":   len(created),
+		"unfilled":  unfilled,
+		"conflicts": conflicts,
+	})
+
+	result.Data, err = json.Marshal(map[string]interface{}{
+		"created":   len(created),
+		"unfilled":  unfilled,
+		"conflicts": conflicts,
+		"load":      judgeLoad(append(existing, created...)),
+	})
+	if err != nil {
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	result.Status = true
+
+	json.NewEncoder(rw).Encode(result)
+	return
+}
+
+func getContestAssignments(rw http.ResponseWriter, r *http.Request) {
+	result := &HTTPResponse{}
+
+	contest := contestFromVars(rw, r, result)
+	if contest == nil {
+		return
+	}
+
+	assignments := []Assignment{}
+	err := mgm.Coll(&Assignment{}).SimpleFind(&assignments, bson.M{"contestId": contest.ID})
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	judge := r.URL.Query().Get("judge")
+	status := r.URL.Query().Get("status")
+
+	filtered := []Assignment{}
+	for _, assignment := range assignments {
+		if (judge == "" || assignment.Judge == judge) && (status == "" || assignment.Status == status) {
+			filtered = append(filtered, assignment)
+		}
+	}
+
+	result.Data, err = json.Marshal(map[string]interface{}{
+		"judging": contest.Judging,
+		"data":    filtered,
+		"load":    judgeLoad(assignments),
+	})
+	if err != nil {
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	result.Status = true
+
+	json.NewEncoder(rw).Encode(result)
+	return
+}
+
+//reassignAssignment move a pending assignment to another judge
+func reassignAssignment(rw http.ResponseWriter, r *http.Request) {
+	result := &HTTPResponse{}
+
+	mapReassign := &struct {
+		Judge string `json:"judge"`
+	}{}
+
+	rules := govalidator.MapData{
+		"judge": []string{"required"},
+	}
+
+	opts := govalidator.Options{
+		Request: r,
+		Data:    mapReassign,
+		Rules:   rules,
+	}
+
+	v := govalidator.New(opts)
+	if e := v.ValidateJSON(); len(e) != 0 {
+		result.ValidationError = e
+
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	assignment := &Assignment{}
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err == nil {
+		err = mgm.Coll(assignment).FindByID(id, assignment)
+	}
+	if err != nil {
+		result.ErrorMsg = "Data Not Found"
+
+		rw.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	if assignment.Status != assignmentPending {
+		result.ErrorMsg = "Only pending assignments can be reassigned"
+
+		rw.WriteHeader(http.StatusConflict)
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	judges, _, err := activeJudges([]string{mapReassign.Judge})
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	if len(judges) == 0 {
+		result.ValidationError = url.Values{
+			"judge": []string{"The judge field must be an active judge"},
+		}
+
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	contestant := &Contestant{}
+	err = mgm.Coll(contestant).FindByID(assignment.ContestantID, contestant)
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	conflicted, err := isConflicted(&judges[0], contestant)
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	if conflicted {
+		refuseConflict(rw, r, result, mapReassign.Judge, contestant)
+		return
+	}
+
+	other, err := findAssignment(assignment.ContestantID, mapReassign.Judge)
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	if other != nil {
+		result.ErrorMsg = "Contestant is already assigned to this judge"
+
+		rw.WriteHeader(http.StatusConflict)
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	contest, err := findContest(assignment.ContestID.Hex())
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	if contest != nil && contest.Judging != nil && contest.Judging.MaxPerJudge > 0 {
+		load, err := mgm.Coll(assignment).CountDocuments(mgm.Ctx(), bson.M{
+			"contestId": assignment.ContestID,
+			"judge":     mapReassign.Judge,
+		})
+		if err != nil {
+			log.Println(err)
+			result.ErrorMsg = err.Error()
+			json.NewEncoder(rw).Encode(result)
+			return
+		}
+		if load >= int64(contest.Judging.MaxPerJudge) {
+			result.ErrorMsg = "Judge already reached the assignment cap"
+
+			rw.WriteHeader(http.StatusConflict)
+			json.NewEncoder(rw).Encode(result)
+			return
+		}
+	}
+
+	before := *assignment
+	assignment.Judge = mapReassign.Judge
+	assignment.AssignedBy = adminFromContext(r).Username
+
+	err = mgm.Coll(assignment).Update(assignment)
+	if isDuplicateKeyError(err) {
+		result.ErrorMsg = "Contestant is already assigned to this judge"
+
+		rw.WriteHeader(http.StatusConflict)
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	recordAudit(r, "assignment.reassign", auditTargetAssignment, assignment.ID.Hex(), before, assignment)
+
+	result.Data, err = json.Marshal(assignment)
+	if err != nil {
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	result.Status = true
+
+	json.NewEncoder(rw).Encode(result)
+	return
+}
+
+//completeAssignment mark the assignment of contestant to judge done
+func completeAssignment(assignment *Assignment) error {
+	if assignment.Status == assignmentDone {
+		return nil
+	}
+
+	now := time.Now()
+	assignment.Status = assignmentDone
+	assignment.CompletedAt = &now
+
+	return mgm.Coll(assignment).Update(assignment)
+}
+
+//getJudgeQueue contestants assigned to the judge, optionally limited to a
+//contest and a status
+func getJudgeQueue(rw http.ResponseWriter, r *http.Request) {
+	result := &HTTPResponse{}
+
+	judge := adminFromContext(r)
+
+	filter := bson.M{"judge": judge.Username}
+	if status := r.URL.Query().Get("status"); status != "" {
+		filter["status"] = status
+	}
+	if r.URL.Query().Get("contest") != "" {
+		contest, e, err := contestFromRequest(r, false)
+		if err != nil {
+			log.Println(err)
+			result.ErrorMsg = err.Error()
+			json.NewEncoder(rw).Encode(result)
+			return
+		}
+		if len(e) != 0 {
+			result.ValidationError = e
+			json.NewEncoder(rw).Encode(result)
+			return
+		}
+		filter["contestId"] = contest.ID
+	}
+
+	assignments := []Assignment{}
+	findOptions := &options.FindOptions{}
+	findOptions.SetSort(bson.M{"created_at": 1})
+
+	err := mgm.Coll(&Assignment{}).SimpleFind(&assignments, filter, findOptions)
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	contestantIDs := []primitive.ObjectID{}
+	for _, assignment := range assignments {
+		contestantIDs = append(contestantIDs, assignment.ContestantID)
+	}
+
+	contestants := []Contestant{}
+	err = mgm.Coll(&Contestant{}).SimpleFind(&contestants, bson.M{"_id": bson.M{"$in": contestantIDs}})
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	contestantByID := map[primitive.ObjectID]*Contestant{}
+	for i := range contestants {
+		contestantByID[contestants[i].ID] = &contestants[i]
+	}
+
+	scores := []Score{}
+	err = mgm.Coll(&Score{}).SimpleFind(&scores, bson.M{"judge": judge.Username, "contestantId": bson.M{"$in": contestantIDs}})
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	scoreByContestant := map[primitive.ObjectID]*Score{}
+	for i := range scores {
+		scoreByContestant[scores[i].ContestantID] = &scores[i]
+	}
+
+	queue := []judgingContestant{}
+	for _, assignment := range assignments {
+		contestant, ok := contestantByID[assignment.ContestantID]
+		if !ok {
+			continue
+		}
+
+		queue = append(queue, judgingContestant{
+			ID:        contestant.ID,
+			ContestID: assignment.ContestID,
+			Title:     contestant.Title,
+			Video:     contestant.Video,
+			Status:    assignment.Status,
+			Score:     scoreByContestant[contestant.ID],
+		})
+	}
+
+	result.Data, err = json.Marshal(queue)
+	if err != nil {
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	result.Status = true
+
+	json.NewEncoder(rw).Encode(result)
+	return
+}
@@ -0,0 +1,142 @@
+// Copyright (C) 2021 Administrator
+//
+// This file is part of backend.
+//
+// backend is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// backend is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with backend.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestPlanAssignments(t *testing.T) {
+	c1, c2, c3, c4 := primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID()
+
+	tests := []struct {
+		name          string
+		contestants   []primitive.ObjectID
+		judges        []string
+		existing      []Assignment
+		perContestant int
+		maxPerJudge   int
+		allowed       func(primitive.ObjectID, string) bool
+		wantPairs     int
+		wantUnfilled  int
+		wantMaxLoad   int
+	}{
+		{
+			name:          "spreads contestants evenly",
+			contestants:   []primitive.ObjectID{c1, c2, c3, c4},
+			judges:        []string{"ana", "budi"},
+			perContestant: 1,
+			wantPairs:     4,
+			wantMaxLoad:   2,
+		},
+		{
+			name:          "gives each contestant distinct judges",
+			contestants:   []primitive.ObjectID{c1, c2},
+			judges:        []string{"ana", "budi", "cici"},
+			perContestant: 3,
+			wantPairs:     6,
+			wantMaxLoad:   2,
+		},
+		{
+			name:          "cannot ask for more judges than there are",
+			contestants:   []primitive.ObjectID{c1},
+			judges:        []string{"ana", "budi"},
+			perContestant: 3,
+			wantPairs:     2,
+			wantUnfilled:  1,
+			wantMaxLoad:   1,
+		},
+		{
+			name:          "counts existing assignments",
+			contestants:   []primitive.ObjectID{c1, c2},
+			judges:        []string{"ana", "budi"},
+			existing:      []Assignment{{ContestantID: c1, Judge: "ana"}},
+			perContestant: 1,
+			wantPairs:     1,
+			wantMaxLoad:   1,
+		},
+		{
+			name:          "stops at the judge cap",
+			contestants:   []primitive.ObjectID{c1, c2, c3, c4},
+			judges:        []string{"ana", "budi"},
+			perContestant: 1,
+			maxPerJudge:   1,
+			wantPairs:     2,
+			wantUnfilled:  2,
+			wantMaxLoad:   1,
+		},
+		{
+			name:          "skips conflicted judges",
+			contestants:   []primitive.ObjectID{c1, c2},
+			judges:        []string{"ana", "budi"},
+			perContestant: 2,
+			allowed: func(contestant primitive.ObjectID, judge string) bool {
+				return !(contestant == c1 && judge == "ana")
+			},
+			wantPairs:    3,
+			wantUnfilled: 1,
+			wantMaxLoad:  2,
+		},
+		{
+			name:          "no judges",
+			contestants:   []primitive.ObjectID{c1, c2},
+			judges:        []string{},
+			perContestant: 2,
+			wantUnfilled:  4,
+		},
+	}
+
+	for _, tt := range tests {
+		pairs, unfilled := planAssignments(tt.contestants, tt.judges, tt.existing, tt.perContestant, tt.maxPerJudge, tt.allowed)
+		if len(pairs) != tt.wantPairs {
+			t.Errorf("%s: got %d pairs, want %d", tt.name, len(pairs), tt.wantPairs)
+		}
+		if unfilled != tt.wantUnfilled {
+			t.Errorf("%s: unfilled = %d, want %d", tt.name, unfilled, tt.wantUnfilled)
+		}
+
+		load := map[string]int{}
+		seen := map[assignmentPair]bool{}
+		for _, assignment := range tt.existing {
+			load[assignment.Judge]++
+			seen[assignmentPair{ContestantID: assignment.ContestantID, Judge: assignment.Judge}] = true
+		}
+		for _, pair := range pairs {
+			if seen[pair] {
+				t.Errorf("%s: judge %s assigned twice to %s", tt.name, pair.Judge, pair.ContestantID.Hex())
+			}
+			if tt.allowed != nil && !tt.allowed(pair.ContestantID, pair.Judge) {
+				t.Errorf("%s: judge %s assigned to %s despite a conflict", tt.name, pair.Judge, pair.ContestantID.Hex())
+			}
+			seen[pair] = true
+			load[pair.Judge]++
+		}
+
+		maxLoad := 0
+		for _, count := range load {
+			if count > maxLoad {
+				maxLoad = count
+			}
+		}
+		if maxLoad != tt.wantMaxLoad {
+			t.Errorf("%s: busiest judge has %d, want %d", tt.name, maxLoad, tt.wantMaxLoad)
+		}
+	}
+}
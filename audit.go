@@ -0,0 +1,242 @@
+// Copyright (C) 2021 Administrator
+//
+// This file is part of backend.
+//
+// backend is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// backend is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with backend.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kamva/mgm/v3"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	auditTargetAdmin           = "admin"
+	auditTargetAPIKey          = "api_key"
+	auditTargetCarousel        = "carousel"
+	auditTargetContestant      = "contestant"
+	auditTargetGallery         = "gallery"
+	auditTargetSecuritySetting = "security_setting"
+	auditTargetSession         = "session"
+
+	auditRedacted = "[REDACTED]"
+)
+
+//auditSensitiveFields field names whose values never reach the audit log,
+//matched case insensitively as a substring
+var auditSensitiveFields = []string{"password", "secret", "token", "recovery", "hash"}
+
+func isAuditSensitive(field string) bool {
+	lowered := strings.ToLower(field)
+	for _, sensitive := range auditSensitiveFields {
+		if strings.Contains(lowered, sensitive) {
+			return true
+		}
+	}
+	return false
+}
+
+//auditSnapshot the JSON representation of v as a map, nil when v is nil or
+//not an object
+func auditSnapshot(v interface{}) map[string]interface{} {
+	if v == nil || (reflect.ValueOf(v).Kind() == reflect.Ptr && reflect.ValueOf(v).IsNil()) {
+		return nil
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+
+	snapshot := map[string]interface{}{}
+	if err := json.Unmarshal(b, &snapshot); err != nil {
+		return nil
+	}
+	return snapshot
+}
+
+//redactAudit replace the value of every sensitive field, nested objects
+//included
+func redactAudit(snapshot map[string]interface{}) map[string]interface{} {
+	for field, value := range snapshot {
+		if isAuditSensitive(field) {
+			snapshot[field] = auditRedacted
+			continue
+		}
+		if nested, ok := value.(map[string]interface{}); ok {
+			snapshot[field] = redactAudit(nested)
+		}
+	}
+	return snapshot
+}
+
+//auditDiff keep only the fields that differ between before and after, a
+//create has no before and a delete has no after so those are kept whole
+func auditDiff(before interface{}, after interface{}) (map[string]interface{}, map[string]interface{}) {
+	beforeSnapshot := auditSnapshot(before)
+	afterSnapshot := auditSnapshot(after)
+
+	if beforeSnapshot != nil && afterSnapshot != nil {
+		for field, value := range beforeSnapshot {
+			if other, ok := afterSnapshot[field]; ok && reflect.DeepEqual(value, other) {
+				delete(beforeSnapshot, field)
+				delete(afterSnapshot, field)
+			}
+		}
+	}
+
+	// redacted after diffing so a changed secret still shows up as changed
+	return redactAudit(beforeSnapshot), redactAudit(afterSnapshot)
+}
+
+//auditActor who made the request, API keys are recorded by their prefix
+func auditActor(r *http.Request) string {
+	if admin := adminFromContext(r); admin != nil {
+		return admin.Username
+	}
+	if key := apiKeyFromContext(r); key != nil {
+		return fmt.Sprintf("apikey:%s", key.Prefix)
+	}
+	return ""
+}
+
+//recordAudit append an entry for an action of the authenticated actor,
+//before and after are diffed and stripped of secrets
+func recordAudit(r *http.Request, action string, targetType string, targetID string, before interface{}, after interface{}) {
+	recordAuditAs(r, auditActor(r), action, targetType, targetID, before, after)
+}
+
+//recordAuditAs append an entry for a request that is not authenticated by
+//VerifyAuthTokenMiddleware, like redeeming a reset link
+func recordAuditAs(r *http.Request, actor string, action string, targetType string, targetID string, before interface{}, after interface{}) {
+	beforeDiff, afterDiff := auditDiff(before, after)
+
+	entry := &AuditLog{
+		Actor:      actor,
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   targetID,
+		IP:         getClientIP(r),
+		UserAgent:  r.UserAgent(),
+		Before:     beforeDiff,
+		After:      afterDiff,
+	}
+
+	// a failed write must not undo an action that already happened, it is
+	// still logged so it can be traced
+	if err := mgm.Coll(entry).Create(entry); err != nil {
+		log.Printf("audit write failed: %v actor=%s action=%s target=%s/%s", err, actor, action, targetType, targetID)
+	}
+}
+
+func getAuditLogs(rw http.ResponseWriter, r *http.Request) {
+	result := &HTTPResponse{}
+
+	query := r.URL.Query()
+
+	limit := 20
+	page := 1
+
+	if i, e := strconv.Atoi(query.Get("limit")); e == nil && i >= 1 && i <= 100 {
+		limit = i
+	}
+	if i, e := strconv.Atoi(query.Get("page")); e == nil && i >= 1 {
+		page = i
+	}
+
+	filter := bson.M{}
+	for param, field := range map[string]string{
+		"actor":      "actor",
+		"action":     "action",
+		"targetType": "targetType",
+		"targetId":   "targetId",
+	} {
+		if value := query.Get(param); value != "" {
+			filter[field] = value
+		}
+	}
+
+	createdAt := bson.M{}
+	for param, operator := range map[string]string{"from": "$gte", "to": "$lt"} {
+		value := query.Get(param)
+		if value == "" {
+			continue
+		}
+
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			result.ValidationError = url.Values{
+				param: []string{fmt.Sprintf("The %s field must be an RFC 3339 time", param)},
+			}
+
+			json.NewEncoder(rw).Encode(result)
+			return
+		}
+		createdAt[operator] = t
+	}
+	if len(createdAt) != 0 {
+		filter["created_at"] = createdAt
+	}
+
+	logs := []AuditLog{}
+
+	findOptions := &options.FindOptions{}
+	findOptions.SetSort(bson.M{"created_at": -1})
+	findOptions.SetLimit(int64(limit))
+	findOptions.SetSkip(int64(page*limit - limit))
+
+	err := mgm.Coll(&AuditLog{}).SimpleFind(&logs, filter, findOptions)
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	total, err := mgm.Coll(&AuditLog{}).CountDocuments(mgm.Ctx(), filter)
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	result.Data, err = json.Marshal(map[string]interface{}{
+		"data":  logs,
+		"limit": limit,
+		"page":  page,
+		"total": total,
+	})
+	if err != nil {
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	result.Status = true
+
+	json.NewEncoder(rw).Encode(result)
+	return
+}
@@ -21,6 +21,7 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
@@ -28,12 +29,23 @@ import (
 // Config struct
 type Config struct {
 	Server struct {
-		Host string `yaml:"host"`
-		Port string `yaml:"port"`
+		Host           string   `yaml:"host"`
+		Port           string   `yaml:"port"`
+		TrustedProxies []string `yaml:"trusted-proxies"`
 	} `yaml:"server"`
 	JWT struct {
-		SecretKey        string `yaml:"secret-key"`
-		RefreshSecretKey string `yaml:"refresh-secret-key"`
+		Algorithm            string        `yaml:"algorithm"`
+		SecretKey            string        `yaml:"secret-key"`
+		RefreshSecretKey     string        `yaml:"refresh-secret-key"`
+		AccessTokenLifetime  time.Duration `yaml:"access-token-lifetime"`
+		RefreshTokenLifetime time.Duration `yaml:"refresh-token-lifetime"`
+		RefreshIdleTimeout   time.Duration `yaml:"refresh-idle-timeout"`
+		ActiveKeyID          string        `yaml:"active-key-id"`
+		Keys                 []struct {
+			ID         string `yaml:"id"`
+			PrivateKey string `yaml:"private-key"`
+			PublicKey  string `yaml:"public-key"`
+		} `yaml:"keys"`
 	} `yaml:"jwt"`
 	Google struct {
 		Drive struct {
@@ -48,6 +60,84 @@ type Config struct {
 		Port     int    `yaml:"port"`
 		Database string `yaml:"database"`
 	} `yaml:"mongodb"`
+	Superadmin struct {
+		Username string `yaml:"username"`
+		Password string `yaml:"password"`
+	} `yaml:"superadmin"`
+	TOTP struct {
+		Issuer string `yaml:"issuer"`
+	} `yaml:"totp"`
+	SMTP struct {
+		Host     string `yaml:"host"`
+		Port     string `yaml:"port"`
+		Username string `yaml:"username"`
+		Password string `yaml:"password"`
+		From     string `yaml:"from"`
+	} `yaml:"smtp"`
+	PasswordReset struct {
+		URL string        `yaml:"url"`
+		TTL time.Duration `yaml:"ttl"`
+	} `yaml:"password-reset"`
+	PasswordPolicy struct {
+		MinLength     int    `yaml:"min-length"`
+		MaxLength     int    `yaml:"max-length"`
+		RequireUpper  bool   `yaml:"require-upper"`
+		RequireLower  bool   `yaml:"require-lower"`
+		RequireDigit  bool   `yaml:"require-digit"`
+		RequireSymbol bool   `yaml:"require-symbol"`
+		BreachedList  string `yaml:"breached-list"`
+	} `yaml:"password-policy"`
+	Login struct {
+		MaxAttemptsPerIP       int           `yaml:"max-attempts-per-ip"`
+		MaxAttemptsPerUsername int           `yaml:"max-attempts-per-username"`
+		AttemptWindow          time.Duration `yaml:"attempt-window"`
+		LockoutDuration        time.Duration `yaml:"lockout-duration"`
+	} `yaml:"login"`
+	OIDC struct {
+		Issuer         string   `yaml:"issuer"`
+		ClientID       string   `yaml:"client-id"`
+		ClientSecret   string   `yaml:"client-secret"`
+		RedirectURL    string   `yaml:"redirect-url"`
+		AllowedDomains []string `yaml:"allowed-domains"`
+	} `yaml:"oidc"`
+	Contest struct {
+		TimeZone string `yaml:"time-zone"`
+	} `yaml:"contest"`
+	ContestantVerification struct {
+		URL         string        `yaml:"url"`
+		ExpireAfter time.Duration `yaml:"expire-after"`
+	} `yaml:"contestant-verification"`
+	OTP struct {
+		Provider       string        `yaml:"provider"`
+		CodeTTL        time.Duration `yaml:"code-ttl"`
+		ResendCooldown time.Duration `yaml:"resend-cooldown"`
+		MaxAttempts    int           `yaml:"max-attempts"`
+		MaxSendsPerDay int           `yaml:"max-sends-per-day"`
+		MaxSendsPerIP  int           `yaml:"max-sends-per-ip"`
+		Zenziva        struct {
+			URL     string `yaml:"url"`
+			UserKey string `yaml:"user-key"`
+			PassKey string `yaml:"pass-key"`
+		} `yaml:"zenziva"`
+		Wablas struct {
+			Host  string `yaml:"host"`
+			Token string `yaml:"token"`
+		} `yaml:"wablas"`
+		Fonnte struct {
+			URL   string `yaml:"url"`
+			Token string `yaml:"token"`
+		} `yaml:"fonnte"`
+	} `yaml:"otp"`
+	Voting struct {
+		CodeTTL              time.Duration `yaml:"code-ttl"`
+		MaxRequestsPerIP     int           `yaml:"max-requests-per-ip"`
+		MaxRequestsPerDevice int           `yaml:"max-requests-per-device"`
+		RequestWindow        time.Duration `yaml:"request-window"`
+		BurstLimit           int           `yaml:"burst-limit"`
+		BurstWindow          time.Duration `yaml:"burst-window"`
+		SharedIPLimit        int           `yaml:"shared-ip-limit"`
+		SharedDeviceLimit    int           `yaml:"shared-device-limit"`
+	} `yaml:"voting"`
 	Redis struct {
 		Host string `yaml:"host"`
 		Port string `yaml:"port"`
@@ -69,6 +159,93 @@ func NewConfig(configPath string) (*Config, error) {
 		return nil, err
 	}
 
+	if config.JWT.AccessTokenLifetime <= 0 {
+		config.JWT.AccessTokenLifetime = 15 * time.Minute
+	}
+	if config.JWT.RefreshTokenLifetime <= 0 {
+		config.JWT.RefreshTokenLifetime = 7 * 24 * time.Hour
+	}
+	if config.TOTP.Issuer == "" {
+		config.TOTP.Issuer = "M2M Competition"
+	}
+	if config.PasswordReset.TTL <= 0 {
+		config.PasswordReset.TTL = time.Hour
+	}
+	if config.PasswordPolicy.MinLength <= 0 {
+		config.PasswordPolicy.MinLength = 8
+	}
+	if config.PasswordPolicy.MaxLength <= 0 {
+		config.PasswordPolicy.MaxLength = 32
+	}
+	if config.Login.MaxAttemptsPerIP <= 0 {
+		config.Login.MaxAttemptsPerIP = 50
+	}
+	if config.Login.MaxAttemptsPerUsername <= 0 {
+		config.Login.MaxAttemptsPerUsername = 5
+	}
+	if config.Login.AttemptWindow <= 0 {
+		config.Login.AttemptWindow = 15 * time.Minute
+	}
+	if config.Login.LockoutDuration <= 0 {
+		config.Login.LockoutDuration = 15 * time.Minute
+	}
+	if config.Contest.TimeZone == "" {
+		config.Contest.TimeZone = "Asia/Jakarta"
+	}
+	if config.ContestantVerification.ExpireAfter <= 0 {
+		config.ContestantVerification.ExpireAfter = 48 * time.Hour
+	}
+	if config.OTP.CodeTTL <= 0 {
+		config.OTP.CodeTTL = 5 * time.Minute
+	}
+	if config.OTP.ResendCooldown <= 0 {
+		config.OTP.ResendCooldown = time.Minute
+	}
+	if config.OTP.MaxAttempts <= 0 {
+		config.OTP.MaxAttempts = 5
+	}
+	if config.OTP.MaxSendsPerDay <= 0 {
+		config.OTP.MaxSendsPerDay = 5
+	}
+	if config.OTP.MaxSendsPerIP <= 0 {
+		config.OTP.MaxSendsPerIP = 20
+	}
+	if config.OTP.Zenziva.URL == "" {
+		config.OTP.Zenziva.URL = "https://console.zenziva.net/reguler/api/sendsms/"
+	}
+	if config.OTP.Fonnte.URL == "" {
+		config.OTP.Fonnte.URL = "https://api.fonnte.com/send"
+	}
+	if config.Voting.CodeTTL <= 0 {
+		config.Voting.CodeTTL = 10 * time.Minute
+	}
+	if config.Voting.MaxRequestsPerIP <= 0 {
+		config.Voting.MaxRequestsPerIP = 30
+	}
+	if config.Voting.MaxRequestsPerDevice <= 0 {
+		config.Voting.MaxRequestsPerDevice = 10
+	}
+	if config.Voting.RequestWindow <= 0 {
+		config.Voting.RequestWindow = time.Hour
+	}
+	if config.Voting.BurstLimit <= 0 {
+		config.Voting.BurstLimit = 50
+	}
+	if config.Voting.BurstWindow <= 0 {
+		config.Voting.BurstWindow = 5 * time.Minute
+	}
+	if config.Voting.SharedIPLimit <= 0 {
+		config.Voting.SharedIPLimit = 5
+	}
+	if config.Voting.SharedDeviceLimit <= 0 {
+		config.Voting.SharedDeviceLimit = 2
+	}
+
+	// every account of the provider could sign in otherwise
+	if config.OIDC.Issuer != "" && len(config.OIDC.AllowedDomains) == 0 {
+		return nil, fmt.Errorf("oidc.allowed-domains is required when oidc.issuer is set")
+	}
+
 	return config, nil
 }
 
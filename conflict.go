@@ -0,0 +1,393 @@
+// Copyright (C) 2021 Administrator
+//
+// This file is part of backend.
+//
+// backend is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// backend is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with backend.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/kamva/mgm/v3"
+	"github.com/thedevsaddam/govalidator"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	auditTargetConflictException = "conflict_exception"
+
+	conflictErrorMsg = "Judge has a conflict of interest with this contestant"
+)
+
+var schoolSeparators = regexp.MustCompile(`[^\pL\pN]+`)
+
+//conflictPair a contestant and a judge
+type conflictPair struct {
+	ContestantID primitive.ObjectID
+	Judge        string
+}
+
+//normalizeSchool comparable form of a school name, case and punctuation
+//are ignored so "SMAN 1 Jakarta" matches "sman 1, jakarta"
+func normalizeSchool(school string) string {
+	return strings.TrimSpace(schoolSeparators.ReplaceAllString(strings.ToLower(school), " "))
+}
+
+//hasConflict whether judge ever declared an affiliation with the school of
+//contestant, removed affiliations keep counting so dropping one does not
+//clear the way to score its contestants
+func hasConflict(judge *Admin, contestant *Contestant) bool {
+	school := normalizeSchool(contestant.School)
+	if school == "" {
+		return false
+	}
+
+	for _, affiliations := range [][]string{judge.Affiliations, judge.PastAffiliations} {
+		for _, affiliation := range affiliations {
+			if normalizeSchool(affiliation) == school {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//conflictExceptions pairs of a contest allowed despite a conflict
+func conflictExceptions(contestID primitive.ObjectID) (map[conflictPair]bool, error) {
+	exceptions := []ConflictException{}
+
+	err := mgm.Coll(&ConflictException{}).SimpleFind(&exceptions, bson.M{
+		"contestId": contestID,
+		"revokedAt": nil,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	allowed := map[conflictPair]bool{}
+	for _, exception := range exceptions {
+		allowed[conflictPair{ContestantID: exception.ContestantID, Judge: exception.Judge}] = true
+	}
+	return allowed, nil
+}
+
+//isConflicted whether judge has a conflict with contestant that no active
+//exception overrides
+func isConflicted(judge *Admin, contestant *Contestant) (bool, error) {
+	if !hasConflict(judge, contestant) {
+		return false, nil
+	}
+
+	count, err := mgm.Coll(&ConflictException{}).CountDocuments(mgm.Ctx(), bson.M{
+		"contestantId": contestant.ID,
+		"judge":        judge.Username,
+		"revokedAt":    nil,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return count == 0, nil
+}
+
+//refuseConflict keep a trail of a refused conflicted pair and respond 409
+func refuseConflict(rw http.ResponseWriter, r *http.Request, result *HTTPResponse, judge string, contestant *Contestant) {
+	recordAudit(r, "conflict.refused", auditTargetContestant, contestant.ID.Hex(), nil, map[string]interface{}{
+		"judge":  judge,
+		"school": contestant.School,
+		"route":  r.URL.Path,
+	})
+
+	result.ErrorMsg = conflictErrorMsg
+	rw.WriteHeader(http.StatusConflict)
+	json.NewEncoder(rw).Encode(result)
+}
+
+//updateAffiliations declare the schools the admin is affiliated with,
+//removed schools move to the past affiliations which still conflict
+func updateAffiliations(rw http.ResponseWriter, r *http.Request) {
+	result := &HTTPResponse{}
+
+	mapAffiliations := &struct {
+		Affiliations []string `json:"affiliations"`
+	}{}
+
+	rules := govalidator.MapData{
+		"affiliations": []string{},
+	}
+
+	opts := govalidator.Options{
+		Request: r,
+		Data:    mapAffiliations,
+		Rules:   rules,
+	}
+
+	v := govalidator.New(opts)
+	if e := v.ValidateJSON(); len(e) != 0 {
+		result.ValidationError = e
+
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	affiliations := []string{}
+	seen := map[string]bool{}
+	for _, affiliation := range mapAffiliations.Affiliations {
+		normalized := normalizeSchool(affiliation)
+		if normalized == "" || seen[normalized] {
+			continue
+		}
+		seen[normalized] = true
+		affiliations = append(affiliations, strings.TrimSpace(affiliation))
+	}
+	if len(affiliations) > 20 {
+		result.ValidationError = url.Values{
+			"affiliations": []string{"The affiliations field may not have more than 20 schools"},
+		}
+
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	admin := adminFromContext(r)
+	before := *admin
+
+	// every school dropped now or earlier, unless it is declared again
+	past := []string{}
+	for _, affiliation := range append(append([]string{}, before.PastAffiliations...), before.Affiliations...) {
+		normalized := normalizeSchool(affiliation)
+		if normalized == "" || seen[normalized] {
+			continue
+		}
+		seen[normalized] = true
+		past = append(past, affiliation)
+	}
+
+	admin.Affiliations = affiliations
+	admin.PastAffiliations = past
+
+	_, err := mgm.Coll(admin).UpdateOne(mgm.Ctx(), bson.M{"_id": admin.ID}, bson.M{
+		"$set": bson.M{
+			"affiliations":     admin.Affiliations,
+			"pastAffiliations": admin.PastAffiliations,
+			"updated_at":       time.Now(),
+		},
+	})
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	recordAudit(r, "admin.update_affiliations", auditTargetAdmin, admin.ID.Hex(), before, admin)
+
+	result.Data, err = json.Marshal(map[string]interface{}{
+		"affiliations":     admin.Affiliations,
+		"pastAffiliations": admin.PastAffiliations,
+	})
+	if err != nil {
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	result.Status = true
+
+	json.NewEncoder(rw).Encode(result)
+	return
+}
+
+//createConflictException let a judge handle a contestant despite a conflict
+func createConflictException(rw http.ResponseWriter, r *http.Request) {
+	result := &HTTPResponse{}
+
+	mapException := &struct {
+		ContestantID string `json:"contestantId"`
+		Judge        string `json:"judge"`
+		Reason       string `json:"reason"`
+	}{}
+
+	rules := govalidator.MapData{
+		"contestantId": []string{"required"},
+		"judge":        []string{"required"},
+		"reason":       []string{"required", "between:10,500"},
+	}
+
+	opts := govalidator.Options{
+		Request: r,
+		Data:    mapException,
+		Rules:   rules,
+	}
+
+	v := govalidator.New(opts)
+	if e := v.ValidateJSON(); len(e) != 0 {
+		result.ValidationError = e
+
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	contestant := &Contestant{}
+	id, err := primitive.ObjectIDFromHex(mapException.ContestantID)
+	if err == nil {
+		err = mgm.Coll(contestant).FindByID(id, contestant)
+	}
+	if err != nil {
+		result.ValidationError = url.Values{
+			"contestantId": []string{"The contestantId field must be an existing contestant"},
+		}
+
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	judge := &Admin{}
+	err = mgm.Coll(judge).First(bson.M{"username": mapException.Judge, "role": adminRoleJudge}, judge)
+	if err != nil {
+		result.ValidationError = url.Values{
+			"judge": []string{"The judge field must be a judge"},
+		}
+
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	conflicted, err := isConflicted(judge, contestant)
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	if !conflicted {
+		result.ErrorMsg = "There is no conflict to override"
+
+		rw.WriteHeader(http.StatusConflict)
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	exception := &ConflictException{
+		ContestID:    contestant.ContestID,
+		ContestantID: contestant.ID,
+		Judge:        judge.Username,
+		Reason:       mapException.Reason,
+		GrantedBy:    adminFromContext(r).Username,
+	}
+
+	err = mgm.Coll(exception).Create(exception)
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	recordAudit(r, "conflict_exception.create", auditTargetConflictException, exception.ID.Hex(), nil, exception)
+
+	result.Data, err = json.Marshal(exception)
+	if err != nil {
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	result.Status = true
+
+	json.NewEncoder(rw).Encode(result)
+	return
+}
+
+//revokeConflictException stop an exception, it is kept for the trail
+func revokeConflictException(rw http.ResponseWriter, r *http.Request) {
+	result := &HTTPResponse{}
+
+	exception := &ConflictException{}
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err == nil {
+		err = mgm.Coll(exception).FindByID(id, exception)
+	}
+	if err != nil {
+		result.ErrorMsg = "Data Not Found"
+
+		rw.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	if exception.RevokedAt == nil {
+		before := *exception
+
+		now := time.Now()
+		exception.RevokedAt = &now
+		exception.RevokedBy = adminFromContext(r).Username
+
+		err = mgm.Coll(exception).Update(exception)
+		if err != nil {
+			log.Println(err)
+			result.ErrorMsg = err.Error()
+			json.NewEncoder(rw).Encode(result)
+			return
+		}
+
+		recordAudit(r, "conflict_exception.revoke", auditTargetConflictException, exception.ID.Hex(), before, exception)
+	}
+
+	result.Status = true
+
+	json.NewEncoder(rw).Encode(result)
+	return
+}
+
+//getConflictExceptions every exception of a contest, revoked ones included
+func getConflictExceptions(rw http.ResponseWriter, r *http.Request) {
+	result := &HTTPResponse{}
+
+	contest := contestFromVars(rw, r, result)
+	if contest == nil {
+		return
+	}
+
+	exceptions := []ConflictException{}
+	findOptions := &options.FindOptions{}
+	findOptions.SetSort(bson.M{"created_at": -1})
+
+	err := mgm.Coll(&ConflictException{}).SimpleFind(&exceptions, bson.M{"contestId": contest.ID}, findOptions)
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	result.Data, err = json.Marshal(exceptions)
+	if err != nil {
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	result.Status = true
+
+	json.NewEncoder(rw).Encode(result)
+	return
+}
@@ -0,0 +1,433 @@
+// Copyright (C) 2021 Administrator
+//
+// This file is part of backend.
+//
+// backend is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// backend is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with backend.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/kamva/mgm/v3"
+	"github.com/thedevsaddam/govalidator"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const auditTargetContest = "contest"
+
+//IsArchived whether the contest was archived, archived contests stay
+//readable but take no new submissions or content
+func (contest *Contest) IsArchived() bool {
+	return contest.ArchivedAt != nil
+}
+
+//legacyContestSlug contest that content stored before contests existed is
+//moved into
+const legacyContestSlug = "legacy"
+
+//ensureContestIndexes create the unique index on contest slugs
+func ensureContestIndexes() error {
+	_, err := mgm.Coll(&Contest{}).Indexes().CreateOne(mgm.Ctx(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "slug", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+//backfillLegacyContest move contestants, galleries and carousels stored
+//before contests existed into the legacy contest, which is created the
+//first time any are found
+func backfillLegacyContest() error {
+	unscoped := bson.M{"$or": bson.A{
+		bson.M{"contestId": bson.M{"$exists": false}},
+		bson.M{"contestId": primitive.NilObjectID},
+		bson.M{"contestId": nil},
+	}}
+	models := []mgm.Model{&Contestant{}, &Gallery{}, &Carousel{}}
+
+	var contest *Contest
+	for _, model := range models {
+		count, err := mgm.Coll(model).CountDocuments(mgm.Ctx(), unscoped)
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			continue
+		}
+
+		if contest == nil {
+			contest, err = findContest(legacyContestSlug)
+			if err != nil {
+				return err
+			}
+		}
+		if contest == nil {
+			contest = &Contest{
+				Name:      "Legacy contest",
+				Slug:      legacyContestSlug,
+				Timeline:  []ContestMilestone{},
+				CreatedBy: "system",
+			}
+			if err := mgm.Coll(contest).Create(contest); err != nil {
+				return err
+			}
+		}
+
+		res, err := mgm.Coll(model).UpdateMany(mgm.Ctx(), unscoped, bson.M{
+			"$set": bson.M{"contestId": contest.ID},
+		})
+		if err != nil {
+			return err
+		}
+		log.Printf("moved %d %s into the %s contest", res.ModifiedCount, mgm.CollName(model), legacyContestSlug)
+	}
+
+	return nil
+}
+
+//findContest find a contest by its slug or id, returns nil when there is
+//none
+func findContest(ref string) (*Contest, error) {
+	contest := &Contest{}
+
+	filter := bson.M{"slug": strings.ToLower(ref)}
+	if id, err := primitive.ObjectIDFromHex(ref); err == nil {
+		filter = bson.M{"_id": id}
+	}
+
+	err := mgm.Coll(contest).First(filter, contest)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return contest, nil
+}
+
+//contestFromRequest resolve the contest named by the contest query or form
+//field, returns validation errors when it is missing, unknown or, when open
+//is set, archived
+func contestFromRequest(r *http.Request, open bool) (*Contest, url.Values, error) {
+	ref := r.FormValue("contest")
+	if ref == "" {
+		return nil, url.Values{
+			"contest": []string{"The contest field is required"},
+		}, nil
+	}
+
+	contest, err := findContest(ref)
+	if err != nil {
+		return nil, nil, err
+	}
+	if contest == nil {
+		return nil, url.Values{
+			"contest": []string{"The contest field must be an existing contest"},
+		}, nil
+	}
+	if open && contest.IsArchived() {
+		return nil, url.Values{
+			"contest": []string{"The contest field must not be an archived contest"},
+		}, nil
+	}
+
+	return contest, nil, nil
+}
+
+func createContest(rw http.ResponseWriter, r *http.Request) {
+	result := &HTTPResponse{}
+
+	mapContest := &struct {
+		Name        string             `json:"name"`
+		Slug        string             `json:"slug"`
+		Description string             `json:"description"`
+		Rules       string             `json:"rules"`
+		Timeline    []ContestMilestone `json:"timeline"`
+		OpensAt     string             `json:"opensAt"`
+		ClosesAt    string             `json:"closesAt"`
+		GracePeriod int                `json:"gracePeriodMinutes"`
+	}{}
+
+	rules := govalidator.MapData{
+		"name":        []string{"required", "between:3,128"},
+		"slug":        []string{"required", "between:3,64", "regex:^[a-z0-9]+(-[a-z0-9]+)*$"},
+		"description": []string{},
+		"rules":       []string{},
+		"timeline":    []string{},
+		"opensAt":     []string{},
+		"closesAt":    []string{},
+	}
+
+	opts := govalidator.Options{
+		Request: r,
+		Data:    mapContest,
+		Rules:   rules,
+	}
+
+	v := govalidator.New(opts)
+	if e := v.ValidateJSON(); len(e) != 0 {
+		result.ValidationError = e
+
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	for i, milestone := range mapContest.Timeline {
+		if strings.TrimSpace(milestone.Title) == "" || milestone.Date.IsZero() {
+			result.ValidationError = url.Values{
+				"timeline": []string{fmt.Sprintf("The timeline field entry %d must have a title and a date", i+1)},
+			}
+
+			json.NewEncoder(rw).Encode(result)
+			return
+		}
+	}
+	sort.SliceStable(mapContest.Timeline, func(i, j int) bool {
+		return mapContest.Timeline[i].Date.Before(mapContest.Timeline[j].Date)
+	})
+
+	// the window is optional here, it can be set later on its own
+	var window *SubmissionWindow
+	if mapContest.OpensAt != "" || mapContest.ClosesAt != "" {
+		var e url.Values
+		window, e = parseSubmissionWindow(mapContest.OpensAt, mapContest.ClosesAt, mapContest.GracePeriod)
+		if len(e) != 0 {
+			result.ValidationError = e
+
+			json.NewEncoder(rw).Encode(result)
+			return
+		}
+	}
+
+	timeline := mapContest.Timeline
+	if timeline == nil {
+		timeline = []ContestMilestone{}
+	}
+
+	contest := &Contest{
+		Name:        mapContest.Name,
+		Slug:        mapContest.Slug,
+		Description: mapContest.Description,
+		Rules:       mapContest.Rules,
+		Timeline:    timeline,
+		Window:      window,
+		CreatedBy:   adminFromContext(r).Username,
+	}
+
+	// the unique index on slug settles concurrent creates
+	err := mgm.Coll(contest).Create(contest)
+	if isDuplicateKeyError(err) {
+		result.ErrorMsg = "Slug already exist"
+
+		rw.WriteHeader(http.StatusConflict)
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	recordAudit(r, "contest.create", auditTargetContest, contest.ID.Hex(), nil, contest)
+
+	result.Data, err = json.Marshal(contest)
+	if err != nil {
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	result.Status = true
+
+	json.NewEncoder(rw).Encode(result)
+	return
+}
+
+func archiveContest(rw http.ResponseWriter, r *http.Request) {
+	result := &HTTPResponse{}
+
+	contest, err := findContest(mux.Vars(r)["id"])
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	if contest == nil {
+		result.ErrorMsg = "Data Not Found"
+
+		rw.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	if !contest.IsArchived() {
+		before := *contest
+
+		now := time.Now()
+		contest.ArchivedAt = &now
+
+		err = mgm.Coll(contest).Update(contest)
+		if err != nil {
+			log.Println(err)
+			result.ErrorMsg = err.Error()
+			json.NewEncoder(rw).Encode(result)
+			return
+		}
+
+		recordAudit(r, "contest.archive", auditTargetContest, contest.ID.Hex(), before, contest)
+	}
+
+	result.Data, err = json.Marshal(contest)
+	if err != nil {
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	result.Status = true
+
+	json.NewEncoder(rw).Encode(result)
+	return
+}
+
+//listContests contests newest first, archived ones only when withArchived
+func listContests(withArchived bool) ([]Contest, error) {
+	contests := []Contest{}
+
+	filter := bson.M{}
+	if !withArchived {
+		filter["archivedAt"] = nil
+	}
+
+	findOptions := &options.FindOptions{}
+	findOptions.SetSort(bson.M{"created_at": -1})
+
+	err := mgm.Coll(&Contest{}).SimpleFind(&contests, filter, findOptions)
+	return contests, err
+}
+
+//getAllContest every contest for admins, archived ones included
+func getAllContest(rw http.ResponseWriter, r *http.Request) {
+	result := &HTTPResponse{}
+
+	contests, err := listContests(true)
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	result.Data, err = json.Marshal(contests)
+	if err != nil {
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	result.Status = true
+
+	json.NewEncoder(rw).Encode(result)
+	return
+}
+
+//getContests contests open to the public
+func getContests(rw http.ResponseWriter, r *http.Request) {
+	result := &HTTPResponse{}
+
+	contests, err := listContests(false)
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	result.Data, err = json.Marshal(contests)
+	if err != nil {
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	result.Status = true
+
+	json.NewEncoder(rw).Encode(result)
+	return
+}
+
+func getContest(rw http.ResponseWriter, r *http.Request) {
+	result := &HTTPResponse{}
+
+	contest, err := findContest(mux.Vars(r)["slug"])
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	if contest == nil {
+		result.ErrorMsg = "Data Not Found"
+
+		rw.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	result.Data, err = json.Marshal(contest)
+	if err != nil {
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	result.Status = true
+
+	json.NewEncoder(rw).Encode(result)
+	return
+}
+
+//contestFilter filter for content of the contest named by the optional
+//contest query, writes the response and returns false when it is unknown
+func contestFilter(rw http.ResponseWriter, r *http.Request, result *HTTPResponse) (bson.M, bool) {
+	if r.URL.Query().Get("contest") == "" {
+		return bson.M{}, true
+	}
+
+	contest, e, err := contestFromRequest(r, false)
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return nil, false
+	}
+	if len(e) != 0 {
+		result.ValidationError = e
+		json.NewEncoder(rw).Encode(result)
+		return nil, false
+	}
+
+	return bson.M{"contestId": contest.ID}, true
+}
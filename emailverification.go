@@ -0,0 +1,457 @@
+// Copyright (C) 2021 Administrator
+//
+// This file is part of backend.
+//
+// backend is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// backend is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with backend.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/kamva/mgm/v3"
+	"github.com/thedevsaddam/govalidator"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	emailCodeLength       = 6
+	maxEmailCodeAttempts  = 5
+	emailVerifyCooldown   = time.Minute
+	emailVerifySweepEvery = 10 * time.Minute
+
+	emailVerifyInvalidMsg = "The verification is invalid or expired"
+	emailVerifyExpiredMsg = "Email was not verified in time"
+)
+
+func emailVerifyTokenKey(tokenHash string) string {
+	return fmt.Sprintf("email-verify-token:%s", tokenHash)
+}
+
+func emailVerifyCodeKey(contestantID primitive.ObjectID) string {
+	return fmt.Sprintf("email-verify-code:%s", contestantID.Hex())
+}
+
+func emailVerifyAttemptsKey(contestantID primitive.ObjectID) string {
+	return fmt.Sprintf("email-verify-attempts:%s", contestantID.Hex())
+}
+
+func emailVerifyCooldownKey(contestantID primitive.ObjectID) string {
+	return fmt.Sprintf("email-verify-cooldown:%s", contestantID.Hex())
+}
+
+//IsEmailVerified whether the submission counts, contestants stored before
+//verification existed have no deadline and count as verified
+func (contestant *Contestant) IsEmailVerified() bool {
+	return contestant.EmailVerifiedAt != nil || contestant.VerificationExpiresAt == nil
+}
+
+//verifiedContestantFilter filter matching contestants whose submission counts
+func verifiedContestantFilter() bson.M {
+	return bson.M{"$or": bson.A{
+		bson.M{"emailVerifiedAt": bson.M{"$ne": nil}},
+		bson.M{"verificationExpiresAt": nil},
+	}}
+}
+
+func emailVerificationLink(token string) string {
+	link, err := url.Parse(cfg.ContestantVerification.URL)
+	if err != nil {
+		return fmt.Sprintf("%s?token=%s", cfg.ContestantVerification.URL, token)
+	}
+
+	query := link.Query()
+	query.Set("token", token)
+	link.RawQuery = query.Encode()
+
+	return link.String()
+}
+
+//sendEmailVerification mail a link and a code either of which verifies the
+//email of contestant, earlier links and codes stop working
+func sendEmailVerification(contestant *Contestant) error {
+	token, err := randomToken()
+	if err != nil {
+		return err
+	}
+	code, err := randomDigits(emailCodeLength)
+	if err != nil {
+		return err
+	}
+
+	ttl := time.Until(*contestant.VerificationExpiresAt)
+	if ttl <= 0 {
+		return nil
+	}
+
+	previous, err := redisClient.Get(emailVerifyCodeKey(contestant.ID)).Result()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+	if previous != "" {
+		var stale struct {
+			TokenHash string `json:"tokenHash"`
+		}
+		if json.Unmarshal([]byte(previous), &stale) == nil {
+			redisClient.Del(emailVerifyTokenKey(stale.TokenHash))
+		}
+	}
+
+	pending, err := json.Marshal(map[string]string{
+		"tokenHash": hashResetToken(token),
+		"codeHash":  hashResetToken(code),
+	})
+	if err != nil {
+		return err
+	}
+
+	pipe := redisClient.TxPipeline()
+	pipe.Set(emailVerifyTokenKey(hashResetToken(token)), contestant.ID.Hex(), ttl)
+	pipe.Set(emailVerifyCodeKey(contestant.ID), pending, ttl)
+	pipe.Del(emailVerifyAttemptsKey(contestant.ID))
+	if _, err := pipe.Exec(); err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf(
+		"Hi %s,\n\n"+
+			"Thank you for submitting \"%s\". Confirm this is your email by opening\n"+
+			"the link below or entering the code %s on the submission page:\n\n"+
+			"%s\n\n"+
+			"Submissions that are not confirmed by %s are removed from the contest.\n",
+		contestant.Name,
+		contestant.Title,
+		code,
+		emailVerificationLink(token),
+		contestant.VerificationExpiresAt.In(contestLocation).Format(windowDisplayLayout),
+	)
+
+	go func(to string) {
+		if err := mailer.Send(to, "Confirm your submission email", body); err != nil {
+			log.Println(err)
+		}
+	}(contestant.Email)
+
+	return nil
+}
+
+//markEmailVerified record the email of contestant as verified and drop its
+//pending link and code
+func markEmailVerified(contestant *Contestant, tokenHash string) error {
+	now := time.Now()
+	contestant.EmailVerifiedAt = &now
+
+	// only the field is set, the workflow may have moved the contestant since
+	// it was read
+	_, err := mgm.Coll(contestant).UpdateOne(mgm.Ctx(), bson.M{"_id": contestant.ID}, bson.M{
+		"$set": bson.M{"emailVerifiedAt": now, "updated_at": now},
+	})
+	if err != nil {
+		return err
+	}
+
+	// the contestant joins the scores judge means are taken over
+	clearLeaderboard(contestant.ContestID, leaderboardScores)
+
+	keys := []string{emailVerifyCodeKey(contestant.ID), emailVerifyAttemptsKey(contestant.ID)}
+	if tokenHash != "" {
+		keys = append(keys, emailVerifyTokenKey(tokenHash))
+	}
+	return redisClient.Del(keys...).Err()
+}
+
+//pendingVerification contestant that may still verify its email, nil when
+//it is unknown, already verified or expired
+func pendingVerification(id primitive.ObjectID) *Contestant {
+	contestant := &Contestant{}
+	err := mgm.Coll(contestant).FindByID(id, contestant)
+	if err != nil {
+		return nil
+	}
+	if contestant.EmailVerifiedAt != nil || contestant.VerificationExpiresAt == nil ||
+		time.Now().After(*contestant.VerificationExpiresAt) || contestant.State() == contestantExpired {
+		return nil
+	}
+
+	return contestant
+}
+
+//verifyContestantEmail verify a submission email with the token of the
+//emailed link, or with the contestant id and the emailed code
+func verifyContestantEmail(rw http.ResponseWriter, r *http.Request) {
+	result := &HTTPResponse{}
+
+	mapVerify := &struct {
+		Token        string `json:"token"`
+		ContestantID string `json:"contestantId"`
+		Code         string `json:"code"`
+	}{}
+
+	rules := govalidator.MapData{
+		"token":        []string{},
+		"contestantId": []string{},
+		"code":         []string{fmt.Sprintf("digits:%d", emailCodeLength)},
+	}
+
+	opts := govalidator.Options{
+		Request: r,
+		Data:    mapVerify,
+		Rules:   rules,
+	}
+
+	v := govalidator.New(opts)
+	if e := v.ValidateJSON(); len(e) != 0 {
+		result.ValidationError = e
+
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	invalid := func() {
+		result.ErrorMsg = emailVerifyInvalidMsg
+
+		rw.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(rw).Encode(result)
+	}
+
+	var contestant *Contestant
+	tokenHash := ""
+
+	switch {
+	case mapVerify.Token != "":
+		tokenHash = hashResetToken(mapVerify.Token)
+
+		hex, err := redisClient.Get(emailVerifyTokenKey(tokenHash)).Result()
+		if err == redis.Nil {
+			invalid()
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			result.ErrorMsg = err.Error()
+			json.NewEncoder(rw).Encode(result)
+			return
+		}
+		id, err := primitive.ObjectIDFromHex(hex)
+		if err == nil {
+			contestant = pendingVerification(id)
+		}
+		if contestant == nil {
+			invalid()
+			return
+		}
+	case mapVerify.ContestantID != "" && mapVerify.Code != "":
+		id, err := primitive.ObjectIDFromHex(mapVerify.ContestantID)
+		if err == nil {
+			contestant = pendingVerification(id)
+		}
+		if contestant == nil {
+			invalid()
+			return
+		}
+
+		raw, err := redisClient.Get(emailVerifyCodeKey(contestant.ID)).Result()
+		if err == redis.Nil {
+			invalid()
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			result.ErrorMsg = err.Error()
+			json.NewEncoder(rw).Encode(result)
+			return
+		}
+		pending := map[string]string{}
+		if err := json.Unmarshal([]byte(raw), &pending); err != nil {
+			result.ErrorMsg = err.Error()
+			json.NewEncoder(rw).Encode(result)
+			return
+		}
+
+		if subtle.ConstantTimeCompare([]byte(hashResetToken(mapVerify.Code)), []byte(pending["codeHash"])) != 1 {
+			attempts, err := incrementWindowFor(emailVerifyAttemptsKey(contestant.ID), time.Until(*contestant.VerificationExpiresAt))
+			if err != nil {
+				log.Println(err)
+			}
+			// the link keeps working, only guessing the code is cut off
+			if attempts >= maxEmailCodeAttempts {
+				redisClient.Del(emailVerifyCodeKey(contestant.ID))
+				logSecurityEvent(r, "email_verify_code_exhausted", "contestant=%s", contestant.ID.Hex())
+			}
+
+			invalid()
+			return
+		}
+		tokenHash = pending["tokenHash"]
+	default:
+		result.ValidationError = url.Values{
+			"token": []string{"Either the token field or the contestantId and code fields are required"},
+		}
+
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	err := markEmailVerified(contestant, tokenHash)
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	result.Data, err = json.Marshal(map[string]interface{}{
+		"contestantId":    contestant.ID,
+		"emailVerifiedAt": contestant.EmailVerifiedAt,
+	})
+	if err != nil {
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	result.Status = true
+
+	json.NewEncoder(rw).Encode(result)
+	return
+}
+
+//resendContestantEmail mail a new link and code, the deadline stays the same
+func resendContestantEmail(rw http.ResponseWriter, r *http.Request) {
+	result := &HTTPResponse{}
+
+	mapResend := &struct {
+		ContestantID string `json:"contestantId"`
+	}{}
+
+	rules := govalidator.MapData{
+		"contestantId": []string{"required"},
+	}
+
+	opts := govalidator.Options{
+		Request: r,
+		Data:    mapResend,
+		Rules:   rules,
+	}
+
+	v := govalidator.New(opts)
+	if e := v.ValidateJSON(); len(e) != 0 {
+		result.ValidationError = e
+
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	// the response does not tell whether the contestant exists
+	result.Status = true
+
+	id, err := primitive.ObjectIDFromHex(mapResend.ContestantID)
+	if err != nil {
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	fresh, err := redisClient.SetNX(emailVerifyCooldownKey(id), 1, emailVerifyCooldown).Result()
+	if err != nil {
+		log.Println(err)
+	}
+	if !fresh {
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	if contestant := pendingVerification(id); contestant != nil {
+		if err := sendEmailVerification(contestant); err != nil {
+			log.Println(err)
+		}
+	}
+
+	json.NewEncoder(rw).Encode(result)
+	return
+}
+
+//expireUnverifiedContestants move submissions past their verification
+//deadline to expired
+func expireUnverifiedContestants() (int64, error) {
+	now := time.Now()
+
+	filter := bson.M{
+		"emailVerifiedAt":       nil,
+		"verificationExpiresAt": bson.M{"$lt": now},
+		"$or": bson.A{
+			bson.M{"status": contestantStateFilter(contestantSubmitted)},
+			bson.M{"status": contestantUnderReview},
+		},
+	}
+
+	contestIDs, err := mgm.Coll(&Contestant{}).Distinct(mgm.Ctx(), "contestId", filter)
+	if err != nil {
+		return 0, err
+	}
+
+	// an update pipeline, statusHistory may be stored as null which $push
+	// refuses, the transition starts from whichever state before approval
+	// the contestant is in
+	res, err := mgm.Coll(&Contestant{}).UpdateMany(mgm.Ctx(), filter, bson.A{
+		bson.M{"$set": bson.M{
+			"status":          contestantExpired,
+			"statusReason":    emailVerifyExpiredMsg,
+			"statusChangedAt": now,
+			"updated_at":      now,
+			"statusHistory": bson.M{"$concatArrays": bson.A{
+				bson.M{"$ifNull": bson.A{"$statusHistory", bson.A{}}},
+				bson.A{bson.M{
+					"from":   bson.M{"$ifNull": bson.A{"$status", contestantSubmitted}},
+					"to":     bson.M{"$literal": contestantExpired},
+					"reason": bson.M{"$literal": emailVerifyExpiredMsg},
+					"by":     bson.M{"$literal": "system"},
+					"at":     now,
+				}},
+			}},
+		}},
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// expired contestants leave the scoring set
+	for _, contestID := range contestIDs {
+		if id, ok := contestID.(primitive.ObjectID); ok {
+			clearLeaderboard(id, leaderboardScores)
+		}
+	}
+
+	return res.ModifiedCount, nil
+}
+
+//runEmailVerificationSweeper expire unverified submissions periodically
+func runEmailVerificationSweeper() {
+	for {
+		expired, err := expireUnverifiedContestants()
+		if err != nil {
+			log.Println(err)
+		} else if expired > 0 {
+			log.Printf("expired %d unverified submissions", expired)
+		}
+
+		time.Sleep(emailVerifySweepEvery)
+	}
+}
@@ -26,6 +26,7 @@ import (
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
+	"github.com/go-redis/redis/v7"
 	"github.com/twinj/uuid"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -67,9 +68,47 @@ func createAuth(username string, td *tokenDetails) error {
 	if err != nil {
 		return err
 	}
+
+	err = redisClient.HSet(
+		sessionKey(td.SessionID),
+		"access_uuid", td.AccessUUID,
+		"refresh_uuid", td.RefreshUUID,
+	).Err()
+	if err != nil {
+		return err
+	}
+	err = redisClient.Expire(sessionKey(td.SessionID), rt.Sub(now)).Err()
+	if err != nil {
+		return err
+	}
+	// the set outlives every session in it, refreshing an older session must
+	// not cut the newer ones short
+	err = extendExpireScript.Run(
+		redisClient,
+		[]string{adminSessionsKey(username)},
+		rt.Sub(now).Milliseconds(),
+	).Err()
+	if err != nil && err != redis.Nil {
+		return err
+	}
 	return nil
 }
 
+//extendExpireScript set the expiry of a key only when that makes it live
+//longer
+var extendExpireScript = redis.NewScript(`
+local ttl = redis.call("PTTL", KEYS[1])
+if ttl == -2 or (ttl >= 0 and ttl >= tonumber(ARGV[1])) then
+	return 0
+end
+return redis.call("PEXPIRE", KEYS[1], ARGV[1])
+`)
+
+//getAuth get username the token uuid was issued to
+func getAuth(givenUUID string) (string, error) {
+	return redisClient.Get(givenUUID).Result()
+}
+
 func deleteAuth(givenUUID string) (int64, error) {
 	deleted, err := redisClient.Del(givenUUID).Result()
 	if err != nil {
@@ -78,23 +117,32 @@ func deleteAuth(givenUUID string) (int64, error) {
 	return deleted, nil
 }
 
-func createJWTToken(username string) (*tokenDetails, error) {
+//createJWTToken issue a token pair for a session started at sessionStart,
+//the refresh token expires a fixed time after sessionStart unless the idle
+//timeout is configured, then it expires after that much inactivity
+func createJWTToken(username string, sessionID string, sessionStart time.Time) (*tokenDetails, error) {
+	now := time.Now()
+
 	td := &tokenDetails{}
-	td.AtExpires = time.Now().Add(time.Minute * 15).Unix()
+	td.SessionID = sessionID
+	td.AtExpires = now.Add(cfg.JWT.AccessTokenLifetime).Unix()
 	td.AccessUUID = uuid.NewV4().String()
 
-	td.RtExpires = time.Now().Add(time.Hour * 24 * 7).Unix()
+	if cfg.JWT.RefreshIdleTimeout > 0 {
+		td.RtExpires = now.Add(cfg.JWT.RefreshIdleTimeout).Unix()
+	} else {
+		td.RtExpires = sessionStart.Add(cfg.JWT.RefreshTokenLifetime).Unix()
+	}
 	td.RefreshUUID = uuid.NewV4().String()
 
 	atClaims := jwt.MapClaims{}
 	atClaims["username"] = username
 	atClaims["access_uuid"] = td.AccessUUID
+	atClaims["session_id"] = td.SessionID
 	atClaims["exp"] = td.AtExpires
 
-	at := jwt.NewWithClaims(jwt.SigningMethodHS256, atClaims)
-
 	var err error
-	td.AccessToken, err = at.SignedString([]byte(cfg.JWT.SecretKey))
+	td.AccessToken, err = jwtKeys.sign(atClaims, tokenTypeAccess)
 	if err != nil {
 		return nil, err
 	}
@@ -102,9 +150,9 @@ func createJWTToken(username string) (*tokenDetails, error) {
 	rtClaims := jwt.MapClaims{}
 	rtClaims["refresh_uuid"] = td.RefreshUUID
 	rtClaims["username"] = username
+	rtClaims["session_id"] = td.SessionID
 	rtClaims["exp"] = td.RtExpires
-	rt := jwt.NewWithClaims(jwt.SigningMethodHS256, rtClaims)
-	td.RefreshToken, err = rt.SignedString([]byte(cfg.JWT.RefreshSecretKey))
+	td.RefreshToken, err = jwtKeys.sign(rtClaims, tokenTypeRefresh)
 	if err != nil {
 		return nil, err
 	}
@@ -139,9 +187,11 @@ func extractTokenMetadata(r *http.Request) (*accessDetails, error) {
 		if !ok {
 			return nil, err
 		}
+		sessionID, _ := claims["session_id"].(string)
 		return &accessDetails{
 			AccessUUID: accessUUID,
 			Username:   username,
+			SessionID:  sessionID,
 		}, nil
 	}
 
@@ -149,12 +199,7 @@ func extractTokenMetadata(r *http.Request) (*accessDetails, error) {
 }
 
 func verifyJWTToken(tokenString string) (*jwt.Token, error) {
-	token, err := jwt.Parse(tokenString, func(t *jwt.Token) (interface{}, error) {
-		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
-		}
-		return []byte(cfg.JWT.SecretKey), nil
-	})
+	token, err := jwtKeys.parse(tokenString, tokenTypeAccess)
 	if err != nil {
 		return nil, err
 	}
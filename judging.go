@@ -0,0 +1,656 @@
+// Copyright (C) 2021 Administrator
+//
+// This file is part of backend.
+//
+// backend is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// backend is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with backend.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/kamva/mgm/v3"
+	"github.com/thedevsaddam/govalidator"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	auditTargetRubric = "rubric"
+	auditTargetScore  = "score"
+)
+
+var criterionKeyPattern = regexp.MustCompile(`^[a-z0-9_]{1,32}$`)
+
+//judgingContestant what a judge sees of an assigned contestant, personal
+//data is left out so judging stays blind
+type judgingContestant struct {
+	ID        primitive.ObjectID `json:"id"`
+	ContestID primitive.ObjectID `json:"contestId"`
+	Title     string             `json:"title"`
+	Video     *ContestantVideo   `json:"video"`
+	Status    string             `json:"status"`
+	Score     *Score             `json:"score"`
+}
+
+//contestantResult aggregated score of a contestant
+type contestantResult struct {
+	ContestantID primitive.ObjectID `json:"contestantId"`
+	Name         string             `json:"name"`
+	School       string             `json:"school"`
+	Title        string             `json:"title"`
+	Judges       int                `json:"judges"`
+	FinalScore   float64            `json:"finalScore"`
+	Rank         int                `json:"rank"`
+	Criteria     map[string]float64 `json:"criteria"`
+}
+
+//getRubric rubric of the contest, nil when it has none yet
+func getRubric(contestID primitive.ObjectID) (*Rubric, error) {
+	rubric := &Rubric{}
+
+	err := mgm.Coll(rubric).First(bson.M{"contestId": contestID}, rubric)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return rubric, nil
+}
+
+//validateRubric check criteria, errors are returned the same way
+//govalidator does
+func validateRubric(criteria []RubricCriterion) url.Values {
+	errs := url.Values{}
+
+	if len(criteria) == 0 {
+		errs.Add("criteria", "The criteria field is required")
+		return errs
+	}
+
+	keys := map[string]bool{}
+	for i, criterion := range criteria {
+		entry := fmt.Sprintf("The criteria field entry %d", i+1)
+
+		if !criterionKeyPattern.MatchString(criterion.Key) {
+			errs.Add("criteria", fmt.Sprintf("%s must have a key of lowercase letters, digits and underscores", entry))
+		} else if keys[criterion.Key] {
+			errs.Add("criteria", fmt.Sprintf("%s repeats the key %s", entry, criterion.Key))
+		}
+		keys[criterion.Key] = true
+
+		if strings.TrimSpace(criterion.Name) == "" {
+			errs.Add("criteria", fmt.Sprintf("%s must have a name", entry))
+		}
+		if criterion.Weight <= 0 {
+			errs.Add("criteria", fmt.Sprintf("%s must have a positive weight", entry))
+		}
+		if criterion.MaxPoints <= criterion.MinPoints {
+			errs.Add("criteria", fmt.Sprintf("%s must have maxPoints above minPoints", entry))
+		}
+	}
+
+	return errs
+}
+
+//validatePoints check every criterion of rubric got points within its range
+//and nothing else was scored
+func validatePoints(rubric *Rubric, points map[string]float64) url.Values {
+	errs := url.Values{}
+
+	for _, criterion := range rubric.Criteria {
+		value, ok := points[criterion.Key]
+		if !ok {
+			errs.Add("points", fmt.Sprintf("The points field is missing %s", criterion.Key))
+			continue
+		}
+		if value < criterion.MinPoints || value > criterion.MaxPoints {
+			errs.Add("points", fmt.Sprintf("The points field %s must be between %g and %g", criterion.Key, criterion.MinPoints, criterion.MaxPoints))
+		}
+	}
+	for key := range points {
+		if _, ok := rubric.criterion(key); !ok {
+			errs.Add("points", fmt.Sprintf("The points field contains unknown criterion %s", key))
+		}
+	}
+
+	return errs
+}
+
+func (rubric *Rubric) criterion(key string) (RubricCriterion, bool) {
+	for _, criterion := range rubric.Criteria {
+		if criterion.Key == key {
+			return criterion, true
+		}
+	}
+	return RubricCriterion{}, false
+}
+
+//scoreTotal weighted total of points on a 0 to 100 scale, each criterion
+//is scaled to its own range first so criteria with more points do not
+//outweigh their weight
+func scoreTotal(rubric *Rubric, points map[string]float64) float64 {
+	var total, weights float64
+
+	for _, criterion := range rubric.Criteria {
+		scaled := (points[criterion.Key] - criterion.MinPoints) / (criterion.MaxPoints - criterion.MinPoints)
+		total += criterion.Weight * scaled
+		weights += criterion.Weight
+	}
+	if weights == 0 {
+		return 0
+	}
+
+	return total / weights * 100
+}
+
+//aggregateScores final score of every contestant under mode, highest first,
+//contestants nobody scored yet come last without a rank
+func aggregateScores(contestants []Contestant, scores []Score, mode string) []*contestantResult {
+	results := map[primitive.ObjectID]*contestantResult{}
+	ordered := []*contestantResult{}
+
+	for _, contestant := range contestants {
+		result := &contestantResult{
+			ContestantID: contestant.ID,
+			Name:         contestant.Name,
+			School:       contestant.School,
+			Title:        contestant.Title,
+			Criteria:     map[string]float64{},
+		}
+		results[contestant.ID] = result
+		ordered = append(ordered, result)
+	}
+
+	for _, score := range scores {
+		result, ok := results[score.ContestantID]
+		if !ok {
+			continue
+		}
+
+		result.Judges++
+		for key, value := range score.Points {
+			result.Criteria[key] += value
+		}
+	}
+
+	finals := normalizedScores(scores, mode)
+	for _, result := range ordered {
+		if result.Judges == 0 {
+			continue
+		}
+
+		result.FinalScore = finals[result.ContestantID]
+		for key := range result.Criteria {
+			result.Criteria[key] /= float64(result.Judges)
+		}
+	}
+
+	sort.SliceStable(ordered, func(i, j int) bool {
+		if (ordered[i].Judges == 0) != (ordered[j].Judges == 0) {
+			return ordered[j].Judges == 0
+		}
+		return ordered[i].FinalScore > ordered[j].FinalScore
+	})
+	rankResults(ordered)
+
+	return ordered
+}
+
+//contestScoringData contestants of a contest that count and the scores they
+//got, rejected, expired and unverified submissions are left out so they do
+//not move the judge means either
+func contestScoringData(contestID primitive.ObjectID) ([]Contestant, []Score, error) {
+	contestants := []Contestant{}
+	filter := verifiedContestantFilter()
+	filter["contestId"] = contestID
+	filter["status"] = judgedContestantFilter()
+	err := mgm.Coll(&Contestant{}).SimpleFind(&contestants, filter)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	contestantIDs := bson.A{}
+	for _, contestant := range contestants {
+		contestantIDs = append(contestantIDs, contestant.ID)
+	}
+
+	scores := []Score{}
+	err = mgm.Coll(&Score{}).SimpleFind(&scores, bson.M{
+		"contestId":    contestID,
+		"contestantId": bson.M{"$in": contestantIDs},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return contestants, scores, nil
+}
+
+//contestFromVars contest named by the id route variable, writes a 404 and
+//returns nil when there is none
+func contestFromVars(rw http.ResponseWriter, r *http.Request, result *HTTPResponse) *Contest {
+	contest, err := findContest(mux.Vars(r)["id"])
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return nil
+	}
+	if contest == nil {
+		result.ErrorMsg = "Data Not Found"
+
+		rw.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(rw).Encode(result)
+		return nil
+	}
+
+	return contest
+}
+
+func updateContestRubric(rw http.ResponseWriter, r *http.Request) {
+	result := &HTTPResponse{}
+
+	mapRubric := &struct {
+		Criteria []RubricCriterion `json:"criteria"`
+	}{}
+
+	rules := govalidator.MapData{
+		"criteria": []string{"required"},
+	}
+
+	opts := govalidator.Options{
+		Request: r,
+		Data:    mapRubric,
+		Rules:   rules,
+	}
+
+	v := govalidator.New(opts)
+	if e := v.ValidateJSON(); len(e) != 0 {
+		result.ValidationError = e
+
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	if e := validateRubric(mapRubric.Criteria); len(e) != 0 {
+		result.ValidationError = e
+
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	contest := contestFromVars(rw, r, result)
+	if contest == nil {
+		return
+	}
+
+	// totals already given were computed with the old criteria
+	scored, err := mgm.Coll(&Score{}).CountDocuments(mgm.Ctx(), bson.M{"contestId": contest.ID})
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	if scored > 0 {
+		result.ErrorMsg = "Rubric can not change once judges started scoring"
+
+		rw.WriteHeader(http.StatusConflict)
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	rubric, err := getRubric(contest.ID)
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	var before *Rubric
+	if rubric == nil {
+		rubric = &Rubric{ContestID: contest.ID}
+	} else {
+		copied := *rubric
+		before = &copied
+	}
+	rubric.Criteria = mapRubric.Criteria
+	rubric.UpdatedBy = adminFromContext(r).Username
+
+	if rubric.ID.IsZero() {
+		err = mgm.Coll(rubric).Create(rubric)
+	} else {
+		err = mgm.Coll(rubric).Update(rubric)
+	}
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	recordAudit(r, "rubric.update", auditTargetRubric, rubric.ID.Hex(), before, rubric)
+
+	result.Data, err = json.Marshal(rubric)
+	if err != nil {
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	result.Status = true
+
+	json.NewEncoder(rw).Encode(result)
+	return
+}
+
+func getContestRubric(rw http.ResponseWriter, r *http.Request) {
+	result := &HTTPResponse{}
+
+	contest := contestFromVars(rw, r, result)
+	if contest == nil {
+		return
+	}
+
+	rubric, err := getRubric(contest.ID)
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	if rubric == nil {
+		result.ErrorMsg = "Data Not Found"
+
+		rw.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	result.Data, err = json.Marshal(rubric)
+	if err != nil {
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	result.Status = true
+
+	json.NewEncoder(rw).Encode(result)
+	return
+}
+
+//submitScore score an assigned contestant, submitting again replaces the
+//earlier score of the judge
+func submitScore(rw http.ResponseWriter, r *http.Request) {
+	result := &HTTPResponse{}
+
+	mapScore := &struct {
+		Points map[string]float64 `json:"points"`
+	}{}
+
+	rules := govalidator.MapData{
+		"points": []string{"required"},
+	}
+
+	opts := govalidator.Options{
+		Request: r,
+		Data:    mapScore,
+		Rules:   rules,
+	}
+
+	v := govalidator.New(opts)
+	if e := v.ValidateJSON(); len(e) != 0 {
+		result.ValidationError = e
+
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	contestant := &Contestant{}
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err == nil {
+		err = mgm.Coll(contestant).FindByID(id, contestant)
+	}
+	if err != nil {
+		result.ErrorMsg = "Data Not Found"
+
+		rw.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	if !contestant.IsEmailVerified() {
+		result.ErrorMsg = "Contestant has not verified their email"
+
+		rw.WriteHeader(http.StatusConflict)
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	if contestant.IsDropped() {
+		result.ErrorMsg = fmt.Sprintf("Contestant is %s and no longer judged", contestant.State())
+
+		rw.WriteHeader(http.StatusConflict)
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	judge := adminFromContext(r)
+
+	assignment, err := findAssignment(contestant.ID, judge.Username)
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	if assignment == nil {
+		result.ErrorMsg = "Contestant is not assigned to you"
+
+		rw.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	// affiliations may be declared after the assignment was made
+	conflicted, err := isConflicted(judge, contestant)
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	if conflicted {
+		refuseConflict(rw, r, result, judge.Username, contestant)
+		return
+	}
+
+	contest, err := findContest(contestant.ContestID.Hex())
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	if contest == nil || contest.IsArchived() {
+		result.ErrorMsg = "Contest is not open for judging"
+
+		rw.WriteHeader(http.StatusConflict)
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	rubric, err := getRubric(contest.ID)
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	if rubric == nil {
+		result.ErrorMsg = "Contest has no rubric yet"
+
+		rw.WriteHeader(http.StatusConflict)
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	if e := validatePoints(rubric, mapScore.Points); len(e) != 0 {
+		result.ValidationError = e
+
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	score, before, err := upsertScore(contest.ID, contestant.ID, judge.Username, mapScore.Points, scoreTotal(rubric, mapScore.Points))
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	recordAudit(r, "score.submit", auditTargetScore, score.ID.Hex(), before, score)
+
+	if err := completeAssignment(assignment); err != nil {
+		log.Println(err)
+	}
+	refreshScoreLeaderboard(contest, contestant.ID, judge.Username)
+
+	result.Data, err = json.Marshal(score)
+	if err != nil {
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	result.Status = true
+
+	json.NewEncoder(rw).Encode(result)
+	return
+}
+
+//ensureScoreIndexes create the unique index that allows one score per judge
+//and contestant
+func ensureScoreIndexes() error {
+	_, err := mgm.Coll(&Score{}).Indexes().CreateOne(mgm.Ctx(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "contestantId", Value: 1}, {Key: "judge", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+//upsertScore save the score of judge for a contestant in one step, returns
+//the saved score and the one it replaced, nil when there was none
+func upsertScore(contestID primitive.ObjectID, contestantID primitive.ObjectID, judge string, points map[string]float64, total float64) (*Score, *Score, error) {
+	now := time.Now()
+	filter := bson.M{"contestantId": contestantID, "judge": judge}
+	update := bson.M{
+		"$set": bson.M{
+			"contestId":   contestID,
+			"points":      points,
+			"total":       total,
+			"submittedAt": now,
+			"updated_at":  now,
+		},
+		"$setOnInsert": bson.M{"created_at": now},
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.Before)
+
+	var before *Score
+	// two concurrent upserts may both insert, the loser of the unique index
+	// race finds the document on its second try
+	for attempt := 0; attempt < 2; attempt++ {
+		previous := &Score{}
+		err := mgm.Coll(previous).FindOneAndUpdate(mgm.Ctx(), filter, update, opts).Decode(previous)
+		if isDuplicateKeyError(err) && attempt == 0 {
+			continue
+		}
+		if err == nil {
+			before = previous
+		} else if err != mongo.ErrNoDocuments {
+			return nil, nil, err
+		}
+		break
+	}
+
+	score := &Score{}
+	if err := mgm.Coll(score).First(filter, score); err != nil {
+		return nil, nil, err
+	}
+
+	return score, before, nil
+}
+
+//getContestScores final scores of every contestant of a contest, in the
+//mode of the contest unless the mode query asks for another
+func getContestScores(rw http.ResponseWriter, r *http.Request) {
+	result := &HTTPResponse{}
+
+	contest := contestFromVars(rw, r, result)
+	if contest == nil {
+		return
+	}
+
+	contestants, scores, err := contestScoringData(contest.ID)
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	mode := contest.ScoreMode
+	if query := r.URL.Query().Get("mode"); query != "" {
+		mode = query
+	}
+	if mode == "" {
+		mode = scoreModeRaw
+	}
+	if !isScoreMode(mode) {
+		result.ValidationError = url.Values{
+			"mode": []string{fmt.Sprintf("The mode field must be one of %s", strings.Join(scoreModes, ", "))},
+		}
+
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	result.Data, err = json.Marshal(map[string]interface{}{
+		"contest": contest,
+		"mode":    mode,
+		"data":    aggregateScores(contestants, scores, mode),
+	})
+	if err != nil {
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	result.Status = true
+
+	json.NewEncoder(rw).Encode(result)
+	return
+}
@@ -0,0 +1,329 @@
+// Copyright (C) 2021 Administrator
+//
+// This file is part of backend.
+//
+// backend is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// backend is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with backend.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+//SigningMethodEd25519 EdDSA signing method with ed25519 keys, jwt-go v3 does
+//not ship one
+type SigningMethodEd25519 struct{}
+
+//SigningMethodEdDSA ed25519 signing method instance
+var SigningMethodEdDSA = &SigningMethodEd25519{}
+
+func init() {
+	jwt.RegisterSigningMethod(SigningMethodEdDSA.Alg(), func() jwt.SigningMethod {
+		return SigningMethodEdDSA
+	})
+}
+
+//Alg algorithm name of the signing method
+func (m *SigningMethodEd25519) Alg() string {
+	return "EdDSA"
+}
+
+//Verify verify signature with an ed25519.PublicKey
+func (m *SigningMethodEd25519) Verify(signingString, signature string, key interface{}) error {
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKeyType
+	}
+
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(publicKey, []byte(signingString), sig) {
+		return errors.New("ed25519: verification error")
+	}
+
+	return nil
+}
+
+//Sign sign with an ed25519.PrivateKey
+func (m *SigningMethodEd25519) Sign(signingString string, key interface{}) (string, error) {
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+
+	return jwt.EncodeSegment(ed25519.Sign(privateKey, []byte(signingString))), nil
+}
+
+const (
+	tokenTypeAccess  = "access"
+	tokenTypeRefresh = "refresh"
+)
+
+//jwtKey a signing key identified by its key id
+type jwtKey struct {
+	ID         string
+	PrivateKey interface{}
+	PublicKey  interface{}
+}
+
+//jwtKeySet keys used to sign and verify jwt tokens
+type jwtKeySet struct {
+	Method        jwt.SigningMethod
+	Active        *jwtKey
+	Keys          map[string]*jwtKey
+	SecretKey     []byte
+	RefreshSecret []byte
+}
+
+var jwtKeys *jwtKeySet
+
+func (ks *jwtKeySet) isHMAC() bool {
+	_, ok := ks.Method.(*jwt.SigningMethodHMAC)
+	return ok
+}
+
+//sign sign claims as the given token type, asymmetric tokens carry the key
+//id of the active key so old keys keep verifying after rotation
+func (ks *jwtKeySet) sign(claims jwt.MapClaims, tokenType string) (string, error) {
+	claims["token_type"] = tokenType
+	token := jwt.NewWithClaims(ks.Method, claims)
+
+	if ks.isHMAC() {
+		if tokenType == tokenTypeRefresh {
+			return token.SignedString(ks.RefreshSecret)
+		}
+		return token.SignedString(ks.SecretKey)
+	}
+
+	token.Header["kid"] = ks.Active.ID
+	return token.SignedString(ks.Active.PrivateKey)
+}
+
+//parse parse and verify a token of the given token type
+func (ks *jwtKeySet) parse(tokenString string, tokenType string) (*jwt.Token, error) {
+	token, err := jwt.Parse(tokenString, func(t *jwt.Token) (interface{}, error) {
+		if t.Method.Alg() != ks.Method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
+		}
+
+		if ks.isHMAC() {
+			if tokenType == tokenTypeRefresh {
+				return ks.RefreshSecret, nil
+			}
+			return ks.SecretKey, nil
+		}
+
+		kid, _ := t.Header["kid"].(string)
+		key, ok := ks.Keys[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown signing key: %v", t.Header["kid"])
+		}
+		return key.PublicKey, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	claims, _ := token.Claims.(jwt.MapClaims)
+	if claimType, ok := claims["token_type"].(string); ok || !ks.isHMAC() {
+		if claimType != tokenType {
+			return nil, fmt.Errorf("invalid jwt token")
+		}
+	}
+
+	return token, nil
+}
+
+func readPEMFile(path string) ([]byte, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("'%s' is not a PEM file", path)
+	}
+
+	return b, nil
+}
+
+func loadJWTKey(method jwt.SigningMethod, id, privateKeyPath, publicKeyPath string) (*jwtKey, error) {
+	key := &jwtKey{ID: id}
+
+	switch method {
+	case jwt.SigningMethodRS256:
+		if privateKeyPath != "" {
+			b, err := readPEMFile(privateKeyPath)
+			if err != nil {
+				return nil, err
+			}
+			privateKey, err := jwt.ParseRSAPrivateKeyFromPEM(b)
+			if err != nil {
+				return nil, err
+			}
+			key.PrivateKey = privateKey
+			key.PublicKey = &privateKey.PublicKey
+		} else {
+			b, err := readPEMFile(publicKeyPath)
+			if err != nil {
+				return nil, err
+			}
+			publicKey, err := jwt.ParseRSAPublicKeyFromPEM(b)
+			if err != nil {
+				return nil, err
+			}
+			key.PublicKey = publicKey
+		}
+	case SigningMethodEdDSA:
+		if privateKeyPath != "" {
+			b, err := readPEMFile(privateKeyPath)
+			if err != nil {
+				return nil, err
+			}
+			block, _ := pem.Decode(b)
+			parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			privateKey, ok := parsed.(ed25519.PrivateKey)
+			if !ok {
+				return nil, fmt.Errorf("key '%s' is not an ed25519 private key", id)
+			}
+			key.PrivateKey = privateKey
+			key.PublicKey = privateKey.Public()
+		} else {
+			b, err := readPEMFile(publicKeyPath)
+			if err != nil {
+				return nil, err
+			}
+			block, _ := pem.Decode(b)
+			parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			publicKey, ok := parsed.(ed25519.PublicKey)
+			if !ok {
+				return nil, fmt.Errorf("key '%s' is not an ed25519 public key", id)
+			}
+			key.PublicKey = publicKey
+		}
+	}
+
+	return key, nil
+}
+
+//loadJWTKeySet load signing keys from config
+func loadJWTKeySet(config Config) (*jwtKeySet, error) {
+	algorithm := config.JWT.Algorithm
+	if algorithm == "" {
+		algorithm = jwt.SigningMethodHS256.Alg()
+	}
+
+	ks := &jwtKeySet{
+		Keys:          map[string]*jwtKey{},
+		SecretKey:     []byte(config.JWT.SecretKey),
+		RefreshSecret: []byte(config.JWT.RefreshSecretKey),
+	}
+
+	switch algorithm {
+	case jwt.SigningMethodHS256.Alg():
+		ks.Method = jwt.SigningMethodHS256
+		return ks, nil
+	case jwt.SigningMethodRS256.Alg():
+		ks.Method = jwt.SigningMethodRS256
+	case SigningMethodEdDSA.Alg():
+		ks.Method = SigningMethodEdDSA
+	default:
+		return nil, fmt.Errorf("unsupported jwt algorithm '%s'", algorithm)
+	}
+
+	for _, k := range config.JWT.Keys {
+		if k.ID == "" {
+			return nil, fmt.Errorf("jwt key without id")
+		}
+		if k.PrivateKey == "" && k.PublicKey == "" {
+			return nil, fmt.Errorf("jwt key '%s' has no private-key or public-key", k.ID)
+		}
+
+		key, err := loadJWTKey(ks.Method, k.ID, k.PrivateKey, k.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		ks.Keys[k.ID] = key
+	}
+
+	active, ok := ks.Keys[config.JWT.ActiveKeyID]
+	if !ok {
+		return nil, fmt.Errorf("jwt active key '%s' not found", config.JWT.ActiveKeyID)
+	}
+	if active.PrivateKey == nil {
+		return nil, fmt.Errorf("jwt active key '%s' has no private-key", active.ID)
+	}
+	ks.Active = active
+
+	return ks, nil
+}
+
+func base64URLBigInt(i *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(i.Bytes())
+}
+
+//getJWKS publish the public verification keys as a JSON Web Key Set
+func getJWKS(rw http.ResponseWriter, r *http.Request) {
+	keys := []map[string]string{}
+
+	if !jwtKeys.isHMAC() {
+		for _, key := range jwtKeys.Keys {
+			jwk := map[string]string{
+				"kid": key.ID,
+				"use": "sig",
+				"alg": jwtKeys.Method.Alg(),
+			}
+
+			switch publicKey := key.PublicKey.(type) {
+			case *rsa.PublicKey:
+				jwk["kty"] = "RSA"
+				jwk["n"] = base64URLBigInt(publicKey.N)
+				jwk["e"] = base64URLBigInt(big.NewInt(int64(publicKey.E)))
+			case ed25519.PublicKey:
+				jwk["kty"] = "OKP"
+				jwk["crv"] = "Ed25519"
+				jwk["x"] = base64.RawURLEncoding.EncodeToString(publicKey)
+			}
+
+			keys = append(keys, jwk)
+		}
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(rw).Encode(map[string]interface{}{
+		"keys": keys,
+	})
+}
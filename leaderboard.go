@@ -0,0 +1,570 @@
+// Copyright (C) 2021 Administrator
+//
+// This file is part of backend.
+//
+// backend is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// backend is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with backend.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/gorilla/mux"
+	"github.com/kamva/mgm/v3"
+	"github.com/thedevsaddam/govalidator"
+	"github.com/twinj/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	//leaderboardScores ranked by the final jury score in the contest mode
+	leaderboardScores = "scores"
+	//leaderboardVotes ranked by counted public votes
+	leaderboardVotes = "votes"
+)
+
+var leaderboardCategories = []string{leaderboardScores, leaderboardVotes}
+
+const (
+	leaderboardRebuildTimeout  = time.Minute
+	leaderboardRebuildAttempts = 3
+)
+
+//storeLeaderboardScript replace a sorted set with the members of a rebuild
+//unless an update took the rebuild marker meanwhile, the last attempt
+//stores regardless
+var storeLeaderboardScript = redis.NewScript(`
+if redis.call("GET", KEYS[2]) ~= ARGV[1] and ARGV[2] ~= "1" then
+	return 0
+end
+redis.call("DEL", KEYS[1])
+for i = 3, #ARGV, 2 do
+	redis.call("ZADD", KEYS[1], ARGV[i], ARGV[i + 1])
+end
+if redis.call("GET", KEYS[2]) == ARGV[1] then
+	redis.call("DEL", KEYS[2])
+end
+return 1
+`)
+
+//updateLeaderboardScript set members of a cached sorted set, a missing set
+//is rebuilt whole on the next read so only a rebuild in progress is told
+//it is stale
+var updateLeaderboardScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	redis.call("DEL", KEYS[2])
+	return 0
+end
+for i = 1, #ARGV, 2 do
+	redis.call("ZADD", KEYS[1], ARGV[i], ARGV[i + 1])
+end
+return 1
+`)
+
+//leaderboardEntry a ranked contestant
+type leaderboardEntry struct {
+	ContestantID string  `json:"contestantId"`
+	Name         string  `json:"name"`
+	School       string  `json:"school"`
+	Title        string  `json:"title"`
+	Score        float64 `json:"score"`
+	Rank         int     `json:"rank"`
+}
+
+func leaderboardKey(contestID primitive.ObjectID, category string) string {
+	return fmt.Sprintf("leaderboard:%s:%s", contestID.Hex(), category)
+}
+
+//leaderboardRebuildKey marker held by a rebuild while it reads the database
+func leaderboardRebuildKey(contestID primitive.ObjectID, category string) string {
+	return fmt.Sprintf("leaderboard-rebuild:%s:%s", contestID.Hex(), category)
+}
+
+//updateLeaderboard set the score of members in the cached sorted set of a
+//category, the check for the set and the write are one step
+func updateLeaderboard(contestID primitive.ObjectID, category string, members []*redis.Z) {
+	args := []interface{}{}
+	for _, member := range members {
+		args = append(args, member.Score, member.Member)
+	}
+
+	keys := []string{leaderboardKey(contestID, category), leaderboardRebuildKey(contestID, category)}
+	err := updateLeaderboardScript.Run(redisClient, keys, args...).Err()
+	if err != nil && err != redis.Nil {
+		log.Println(err)
+		clearLeaderboard(contestID, category)
+	}
+}
+
+//leaderboardScore score as kept in the sorted set, rounded so floating point
+//noise does not break ties
+func leaderboardScore(score float64) float64 {
+	return math.Round(score*1e4) / 1e4
+}
+
+func contestScoreMode(contest *Contest) string {
+	if contest.ScoreMode == "" {
+		return scoreModeRaw
+	}
+	return contest.ScoreMode
+}
+
+//publicContestants ids of the contestants of a contest public endpoints
+//may show, only they are ranked
+func publicContestants(contestID primitive.ObjectID) (map[primitive.ObjectID]bool, error) {
+	contestants := []Contestant{}
+	err := mgm.Coll(&Contestant{}).SimpleFind(&contestants, bson.M{
+		"contestId": contestID,
+		"status":    publicContestantFilter(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ids := map[primitive.ObjectID]bool{}
+	for _, contestant := range contestants {
+		ids[contestant.ID] = true
+	}
+	return ids, nil
+}
+
+//loadLeaderboard ranking of a category as stored in the database
+func loadLeaderboard(contest *Contest, category string) ([]*redis.Z, error) {
+	members := []*redis.Z{}
+
+	public, err := publicContestants(contest.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	switch category {
+	case leaderboardScores:
+		_, scores, err := contestScoringData(contest.ID)
+		if err != nil {
+			return nil, err
+		}
+		for contestantID, final := range normalizedScores(scores, contestScoreMode(contest)) {
+			if !public[contestantID] {
+				continue
+			}
+			members = append(members, &redis.Z{Score: leaderboardScore(final), Member: contestantID.Hex()})
+		}
+	case leaderboardVotes:
+		cursor, err := mgm.Coll(&Vote{}).Aggregate(mgm.Ctx(), []bson.M{
+			{"$match": bson.M{"contestId": contest.ID, "status": voteCounted}},
+			{"$group": bson.M{"_id": "$contestantId", "count": bson.M{"$sum": 1}}},
+		})
+		if err != nil {
+			return nil, err
+		}
+		groups := []struct {
+			ID    primitive.ObjectID `bson:"_id"`
+			Count int                `bson:"count"`
+		}{}
+		if err := cursor.All(mgm.Ctx(), &groups); err != nil {
+			return nil, err
+		}
+		for _, group := range groups {
+			if !public[group.ID] {
+				continue
+			}
+			members = append(members, &redis.Z{Score: float64(group.Count), Member: group.ID.Hex()})
+		}
+	}
+
+	return members, nil
+}
+
+//rebuildLeaderboard fill the sorted set of a category from the database, a
+//rebuild that an update raced is read again so the update is not lost
+func rebuildLeaderboard(contest *Contest, category string) error {
+	key := leaderboardKey(contest.ID, category)
+	marker := leaderboardRebuildKey(contest.ID, category)
+
+	for attempt := 1; ; attempt++ {
+		token := uuid.NewV4().String()
+		err := redisClient.Set(marker, token, leaderboardRebuildTimeout).Err()
+		if err != nil {
+			return err
+		}
+
+		// a retry may follow a change of the contest itself, like its score
+		// mode
+		if attempt > 1 {
+			fresh, err := findContest(contest.ID.Hex())
+			if err != nil {
+				return err
+			}
+			if fresh != nil {
+				contest = fresh
+			}
+		}
+
+		members, err := loadLeaderboard(contest, category)
+		if err != nil {
+			return err
+		}
+
+		args := []interface{}{token, attempt >= leaderboardRebuildAttempts}
+		for _, member := range members {
+			args = append(args, member.Score, member.Member)
+		}
+		stored, err := storeLeaderboardScript.Run(redisClient, []string{key, marker}, args...).Int()
+		if err != nil {
+			return err
+		}
+		if stored == 1 {
+			return nil
+		}
+	}
+}
+
+//clearLeaderboard drop a cached category, it is rebuilt on the next read, a
+//rebuild in progress loses its marker so it does not store what it read
+//before the change
+func clearLeaderboard(contestID primitive.ObjectID, category string) {
+	err := redisClient.Del(leaderboardKey(contestID, category), leaderboardRebuildKey(contestID, category)).Err()
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+//refreshScoreLeaderboard update the contestants whose final score a new
+//score of judge changed, under z-scores that is everyone the judge scored
+func refreshScoreLeaderboard(contest *Contest, contestantID primitive.ObjectID, judge string) {
+	_, scores, err := contestScoringData(contest.ID)
+	if err != nil {
+		log.Println(err)
+		clearLeaderboard(contest.ID, leaderboardScores)
+		return
+	}
+	public, err := publicContestants(contest.ID)
+	if err != nil {
+		log.Println(err)
+		clearLeaderboard(contest.ID, leaderboardScores)
+		return
+	}
+
+	mode := contestScoreMode(contest)
+	affected := map[primitive.ObjectID]bool{contestantID: true}
+	if mode == scoreModeZScore {
+		for _, score := range scores {
+			if score.Judge == judge {
+				affected[score.ContestantID] = true
+			}
+		}
+	}
+
+	finals := normalizedScores(scores, mode)
+	members := []*redis.Z{}
+	for id := range affected {
+		if final, ok := finals[id]; ok && public[id] {
+			members = append(members, &redis.Z{Score: leaderboardScore(final), Member: id.Hex()})
+		}
+	}
+
+	updateLeaderboard(contest.ID, leaderboardScores, members)
+}
+
+//countVoteOnLeaderboard put the counted votes of a contestant on the cached
+//vote ranking, the total is counted again rather than incremented so a vote
+//a concurrent rebuild already saw is not added twice
+func countVoteOnLeaderboard(contestID primitive.ObjectID, contestantID primitive.ObjectID) {
+	count, err := mgm.Coll(&Vote{}).CountDocuments(mgm.Ctx(), bson.M{
+		"contestId":    contestID,
+		"contestantId": contestantID,
+		"status":       voteCounted,
+	})
+	if err != nil {
+		log.Println(err)
+		clearLeaderboard(contestID, leaderboardVotes)
+		return
+	}
+
+	updateLeaderboard(contestID, leaderboardVotes, []*redis.Z{
+		{Score: float64(count), Member: contestantID.Hex()},
+	})
+}
+
+//leaderboardPage limit entries of a category ranked after the contestant
+//named by cursor, ties share a rank and the next rank skips ahead (1, 2, 2, 4)
+func leaderboardPage(contest *Contest, category string, cursor string, limit int) (map[string]interface{}, url.Values, error) {
+	key := leaderboardKey(contest.ID, category)
+
+	exists, err := redisClient.Exists(key).Result()
+	if err != nil {
+		return nil, nil, err
+	}
+	if exists == 0 {
+		if err := rebuildLeaderboard(contest, category); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var start int64
+	if cursor != "" {
+		position, err := redisClient.ZRevRank(key, cursor).Result()
+		if err == redis.Nil {
+			return nil, url.Values{
+				"cursor": []string{"The cursor is not on this leaderboard"},
+			}, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		start = position + 1
+	}
+
+	// one extra member tells whether there is a next page
+	members, err := redisClient.ZRevRangeWithScores(key, start, start+int64(limit)).Result()
+	if err != nil {
+		return nil, nil, err
+	}
+	total, err := redisClient.ZCard(key).Result()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nextCursor := ""
+	if len(members) > limit {
+		members = members[:limit]
+		nextCursor = members[limit-1].Member.(string)
+	}
+
+	ids := []primitive.ObjectID{}
+	for _, member := range members {
+		if id, err := primitive.ObjectIDFromHex(member.Member.(string)); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	contestants := []Contestant{}
+	err = mgm.Coll(&Contestant{}).SimpleFind(&contestants, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return nil, nil, err
+	}
+	contestantByID := map[string]*Contestant{}
+	for i := range contestants {
+		contestantByID[contestants[i].ID.Hex()] = &contestants[i]
+	}
+
+	entries := []*leaderboardEntry{}
+	for i, member := range members {
+		entry := &leaderboardEntry{
+			ContestantID: member.Member.(string),
+			Score:        member.Score,
+		}
+		if contestant := contestantByID[entry.ContestantID]; contestant != nil {
+			entry.Name = contestant.Name
+			entry.School = contestant.School
+			entry.Title = contestant.Title
+		}
+
+		switch {
+		case i > 0 && members[i-1].Score == member.Score:
+			entry.Rank = entries[i-1].Rank
+		case i > 0:
+			entry.Rank = int(start) + i + 1
+		default:
+			// the page may start inside a tie, rank by how many are ahead
+			ahead, err := redisClient.ZCount(key, "("+strconv.FormatFloat(member.Score, 'f', -1, 64), "+inf").Result()
+			if err != nil {
+				return nil, nil, err
+			}
+			entry.Rank = int(ahead) + 1
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return map[string]interface{}{
+		"contest":    contest.Slug,
+		"category":   category,
+		"data":       entries,
+		"total":      total,
+		"limit":      limit,
+		"nextCursor": nextCursor,
+	}, nil, nil
+}
+
+//leaderboardResponse write the leaderboard page asked for by the query
+func leaderboardResponse(rw http.ResponseWriter, r *http.Request, result *HTTPResponse, contest *Contest) {
+	query := r.URL.Query()
+
+	category := query.Get("category")
+	if category == "" {
+		category = leaderboardScores
+	}
+	if category != leaderboardScores && category != leaderboardVotes {
+		result.ValidationError = url.Values{
+			"category": []string{fmt.Sprintf("The category field must be one of %v", leaderboardCategories)},
+		}
+
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	limit := 20
+	if i, e := strconv.Atoi(query.Get("limit")); e == nil && i >= 1 && i <= 100 {
+		limit = i
+	}
+
+	data, e, err := leaderboardPage(contest, category, query.Get("cursor"), limit)
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	if len(e) != 0 {
+		result.ValidationError = e
+
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	result.Data, err = json.Marshal(data)
+	if err != nil {
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	result.Status = true
+
+	json.NewEncoder(rw).Encode(result)
+	return
+}
+
+//getLeaderboard public leaderboard, a hidden one stays closed until the
+//results are published
+func getLeaderboard(rw http.ResponseWriter, r *http.Request) {
+	result := &HTTPResponse{}
+
+	contest, err := findContest(mux.Vars(r)["slug"])
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	if contest == nil {
+		result.ErrorMsg = "Data Not Found"
+
+		rw.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	if contest.LeaderboardHidden && contest.ResultsPublishedAt == nil {
+		result.ErrorMsg = "Leaderboard is not published yet"
+
+		rw.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	leaderboardResponse(rw, r, result, contest)
+}
+
+//getContestLeaderboard leaderboard for staff, shown even while hidden
+func getContestLeaderboard(rw http.ResponseWriter, r *http.Request) {
+	result := &HTTPResponse{}
+
+	contest := contestFromVars(rw, r, result)
+	if contest == nil {
+		return
+	}
+
+	leaderboardResponse(rw, r, result, contest)
+}
+
+//updateLeaderboardSetting hide the public leaderboard and publish or
+//withdraw the results
+func updateLeaderboardSetting(rw http.ResponseWriter, r *http.Request) {
+	result := &HTTPResponse{}
+
+	mapSetting := &struct {
+		Hidden    *bool `json:"hidden"`
+		Published *bool `json:"published"`
+	}{}
+
+	rules := govalidator.MapData{
+		"hidden":    []string{},
+		"published": []string{},
+	}
+
+	opts := govalidator.Options{
+		Request: r,
+		Data:    mapSetting,
+		Rules:   rules,
+	}
+
+	v := govalidator.New(opts)
+	if e := v.ValidateJSON(); len(e) != 0 {
+		result.ValidationError = e
+
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	contest := contestFromVars(rw, r, result)
+	if contest == nil {
+		return
+	}
+
+	before := *contest
+	if mapSetting.Hidden != nil {
+		contest.LeaderboardHidden = *mapSetting.Hidden
+	}
+	if mapSetting.Published != nil {
+		switch {
+		case *mapSetting.Published && contest.ResultsPublishedAt == nil:
+			now := time.Now()
+			contest.ResultsPublishedAt = &now
+		case !*mapSetting.Published:
+			contest.ResultsPublishedAt = nil
+		}
+	}
+
+	err := mgm.Coll(contest).Update(contest)
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	recordAudit(r, "contest.update_leaderboard", auditTargetContest, contest.ID.Hex(), before, contest)
+
+	result.Data, err = json.Marshal(map[string]interface{}{
+		"hidden":      contest.LeaderboardHidden,
+		"publishedAt": contest.ResultsPublishedAt,
+	})
+	if err != nil {
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	result.Status = true
+
+	json.NewEncoder(rw).Encode(result)
+	return
+}
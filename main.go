@@ -24,6 +24,8 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"time"
+	_ "time/tzdata"
 
 	"github.com/go-redis/redis/v7"
 )
@@ -70,10 +72,11 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	cfg, err := NewConfig(cfgPath)
+	config, err := NewConfig(cfgPath)
 	if err != nil {
 		log.Fatal(err)
 	}
+	cfg = *config
 
 	mongoDBConfig := MongoDBConfig{
 		Username: cfg.MongoDB.Username,
@@ -97,6 +100,24 @@ func main() {
 	gDriveClient = initClient
 	jwtConfig.SecretKey = cfg.JWT.SecretKey
 
+	jwtKeys, err = loadJWTKeySet(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	mailer = SMTPMailer{
+		Host:     cfg.SMTP.Host,
+		Port:     cfg.SMTP.Port,
+		Username: cfg.SMTP.Username,
+		Password: cfg.SMTP.Password,
+		From:     cfg.SMTP.From,
+	}
+
+	otpSender, err = newOTPSender(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	redisClient = redis.NewClient(&redis.Options{
 		Addr: fmt.Sprintf("%s:%s", cfg.Redis.Host, cfg.Redis.Port),
 	})
@@ -105,7 +126,46 @@ func main() {
 		log.Fatal(err)
 	}
 
+	if cfg.PasswordPolicy.BreachedList != "" {
+		breachedPasswords, err = LoadBreachedPasswords(cfg.PasswordPolicy.BreachedList)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	trustedProxies, err = parseTrustedProxies(cfg.Server.TrustedProxies)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := seedSuperadmin(cfg.Superadmin.Username, cfg.Superadmin.Password); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := ensureContestIndexes(); err != nil {
+		log.Fatal(err)
+	}
+	if err := backfillLegacyContest(); err != nil {
+		log.Fatal(err)
+	}
+	if err := ensureVoteIndexes(); err != nil {
+		log.Fatal(err)
+	}
+	if err := ensureScoreIndexes(); err != nil {
+		log.Fatal(err)
+	}
+	if err := ensureAssignmentIndexes(); err != nil {
+		log.Fatal(err)
+	}
+
+	contestLocation, err = time.LoadLocation(cfg.Contest.TimeZone)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	initGovalidatorCustomRule()
 
+	go runEmailVerificationSweeper()
+
 	cfg.RunServer()
 }
@@ -18,8 +18,13 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"log"
 	"net/http"
+
+	"github.com/kamva/mgm/v3"
+	"go.mongodb.org/mongo-driver/bson"
 )
 
 //CORSMiddleware middleware for handling cors
@@ -27,7 +32,7 @@ func CORSMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
 		rw.Header().Set("Access-Control-Allow-Origin", "*")
 		rw.Header().Set("Access-Control-Allow-Headers", "Content-Type,authorization")
-		rw.Header().Set("Access-Control-Allow-Methods", "GET,POST,OPTIONS,PUT")
+		rw.Header().Set("Access-Control-Allow-Methods", "GET,POST,OPTIONS,PUT,DELETE")
 
 		if r.Method == "OPTIONS" {
 			rw.WriteHeader(http.StatusOK)
@@ -45,25 +50,171 @@ func JSONResponseMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-//VerifyAuthTokenMiddleware middleware for verify token authorization
+type contextKey string
+
+const (
+	adminContextKey  contextKey = "admin"
+	accessContextKey contextKey = "access"
+	apiKeyContextKey contextKey = "apiKey"
+)
+
+//adminFromContext get the authenticated admin put by VerifyAuthTokenMiddleware
+func adminFromContext(r *http.Request) *Admin {
+	admin, _ := r.Context().Value(adminContextKey).(*Admin)
+	return admin
+}
+
+//apiKeyFromContext get the API key put by VerifyAuthTokenMiddleware, nil when
+//the request was made by an admin
+func apiKeyFromContext(r *http.Request) *APIKey {
+	key, _ := r.Context().Value(apiKeyContextKey).(*APIKey)
+	return key
+}
+
+//accessFromContext get the access token details put by VerifyAuthTokenMiddleware
+func accessFromContext(r *http.Request) *accessDetails {
+	access, _ := r.Context().Value(accessContextKey).(*accessDetails)
+	return access
+}
+
+func unauthorizedResponse(rw http.ResponseWriter, msg string) {
+	result := &HTTPResponse{}
+	result.ErrorMsg = msg
+
+	rw.WriteHeader(http.StatusUnauthorized)
+	json.NewEncoder(rw).Encode(result)
+}
+
+//verifyAPIKey authorize an API key for routes registered with requireScope
+func verifyAPIKey(next http.Handler, rw http.ResponseWriter, r *http.Request, tokenString string) {
+	key, err := findAPIKey(tokenString)
+	if err != nil {
+		log.Println(err)
+		unauthorizedResponse(rw, "unauthorized")
+		return
+	}
+	if key == nil {
+		unauthorizedResponse(rw, "invalid api key")
+		return
+	}
+
+	scope := routeScope(r)
+	if scope == "" || !key.HasScope(scope) {
+		forbiddenResponse(rw)
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), apiKeyContextKey, key)
+
+	next.ServeHTTP(rw, r.WithContext(ctx))
+}
+
+//VerifyAuthTokenMiddleware middleware for verify token authorization, the
+//bearer token is either an admin JWT or an API key
 func VerifyAuthTokenMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
 		tokenString := extractTokenFromRequest(r)
+		if isAPIKey(tokenString) {
+			verifyAPIKey(next, rw, r, tokenString)
+			return
+		}
+
 		token, err := verifyJWTToken(tokenString)
 		if err != nil {
-			result := &HTTPResponse{}
-			result.ErrorMsg = err.Error()
-
-			rw.WriteHeader(http.StatusUnauthorized)
-			json.NewEncoder(rw).Encode(result)
+			unauthorizedResponse(rw, err.Error())
 			return
 		}
 		if valid := isTokenValid(token); !valid {
-			result := &HTTPResponse{}
-			result.ErrorMsg = "invalid jwt token"
+			unauthorizedResponse(rw, "invalid jwt token")
+			return
+		}
+
+		meta, err := extractTokenMetadata(r)
+		if err != nil || meta == nil {
+			unauthorizedResponse(rw, "invalid jwt token")
+			return
+		}
+
+		username, err := getAuth(meta.AccessUUID)
+		if err != nil || username != meta.Username {
+			unauthorizedResponse(rw, "unauthorized")
+			return
+		}
 
-			rw.WriteHeader(http.StatusUnauthorized)
-			json.NewEncoder(rw).Encode(result)
+		admin := &Admin{}
+		err = mgm.Coll(admin).FindOne(
+			mgm.Ctx(),
+			bson.M{
+				"username": meta.Username,
+			},
+		).Decode(&admin)
+		if err != nil {
+			unauthorizedResponse(rw, "unauthorized")
+			return
+		}
+		if !admin.IsActive {
+			unauthorizedResponse(rw, "Username not active")
+			return
+		}
+
+		if err := touchSession(meta.SessionID); err != nil {
+			log.Println(err)
+		}
+
+		ctx := context.WithValue(r.Context(), adminContextKey, admin)
+		ctx = context.WithValue(ctx, accessContextKey, meta)
+
+		next.ServeHTTP(rw, r.WithContext(ctx))
+	})
+}
+
+//forbiddenResponse respond 403 Forbidden
+func forbiddenResponse(rw http.ResponseWriter) {
+	result := &HTTPResponse{}
+	result.ErrorMsg = "Forbidden"
+
+	rw.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(rw).Encode(result)
+}
+
+//StaffMiddleware middleware for keeping judges out of content and contestant
+//management, API keys already passed their scope check
+func StaffMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if apiKeyFromContext(r) != nil {
+			next.ServeHTTP(rw, r)
+			return
+		}
+
+		admin := adminFromContext(r)
+		if admin == nil || (admin.EffectiveRole() != adminRoleAdmin && admin.EffectiveRole() != adminRoleSuperadmin) {
+			forbiddenResponse(rw)
+			return
+		}
+
+		next.ServeHTTP(rw, r)
+	})
+}
+
+//JudgeMiddleware middleware for allowing only judges
+func JudgeMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		admin := adminFromContext(r)
+		if admin == nil || admin.EffectiveRole() != adminRoleJudge {
+			forbiddenResponse(rw)
+			return
+		}
+
+		next.ServeHTTP(rw, r)
+	})
+}
+
+//SuperadminMiddleware middleware for allowing only active superadmin
+func SuperadminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		admin := adminFromContext(r)
+		if admin == nil || admin.EffectiveRole() != adminRoleSuperadmin {
+			forbiddenResponse(rw)
 			return
 		}
 
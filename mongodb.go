@@ -20,8 +20,11 @@ package main
 import (
 	"fmt"
 	"log"
+	"time"
 
 	"github.com/kamva/mgm/v3"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/mongo/readpref"
@@ -39,11 +42,196 @@ type MongoDBConfig struct {
 //Admin user admin model for mongodb
 type Admin struct {
 	mgm.DefaultModel `bson:",inline"`
-	Name             string `json:"name" bson:"name"`
-	Username         string `json:"username" bson:"username"`
-	ProfileImageURL  string `json:"profileImageUrl" bson:"profileImageUrl"`
-	Password         string `json:"password" bson:"password"`
-	IsActive         bool   `json:"isActive" bson:"isActive"`
+	Name             string   `json:"name" bson:"name"`
+	Username         string   `json:"username" bson:"username"`
+	Email            string   `json:"email" bson:"email"`
+	ProfileImageURL  string   `json:"profileImageUrl" bson:"profileImageUrl"`
+	Password         string   `json:"password" bson:"password"`
+	IsActive         bool     `json:"isActive" bson:"isActive"`
+	Role             string   `json:"role" bson:"role"`
+	TOTPEnabled      bool     `json:"totpEnabled" bson:"totpEnabled"`
+	TOTPSecret       string   `json:"-" bson:"totpSecret"`
+	RecoveryCodes    []string `json:"-" bson:"recoveryCodes"`
+	OIDCSubject      string   `json:"-" bson:"oidcSubject,omitempty"`
+	Affiliations     []string `json:"affiliations" bson:"affiliations"`
+	PastAffiliations []string `json:"pastAffiliations" bson:"pastAffiliations"`
+}
+
+const (
+	adminRoleAdmin      = "admin"
+	adminRoleSuperadmin = "superadmin"
+	adminRoleJudge      = "judge"
+)
+
+//EffectiveRole role of the admin, admins stored before roles existed are
+//plain admins
+func (admin *Admin) EffectiveRole() string {
+	if admin.Role == "" {
+		return adminRoleAdmin
+	}
+	return admin.Role
+}
+
+func isAdminRole(role string) bool {
+	switch role {
+	case adminRoleAdmin, adminRoleSuperadmin, adminRoleJudge:
+		return true
+	}
+
+	return false
+}
+
+//SecuritySetting security policy set by superadmins, a single document
+type SecuritySetting struct {
+	mgm.DefaultModel `bson:",inline"`
+	RequireTOTPRoles []string `json:"requireTotpRoles" bson:"requireTotpRoles"`
+}
+
+//APIKey scoped key for machine integrations, only its hash is stored
+type APIKey struct {
+	mgm.DefaultModel `bson:",inline"`
+	Name             string     `json:"name" bson:"name"`
+	Prefix           string     `json:"prefix" bson:"prefix"`
+	Hash             string     `json:"-" bson:"hash"`
+	Scopes           []string   `json:"scopes" bson:"scopes"`
+	CreatedBy        string     `json:"createdBy" bson:"createdBy"`
+	ExpiresAt        time.Time  `json:"expiresAt" bson:"expiresAt"`
+	LastUsedAt       *time.Time `json:"lastUsedAt" bson:"lastUsedAt"`
+	RevokedAt        *time.Time `json:"revokedAt" bson:"revokedAt"`
+}
+
+//AuditLog append only record of an admin action, entries are never updated
+//or deleted by the application
+type AuditLog struct {
+	mgm.DefaultModel `bson:",inline"`
+	Actor            string                 `json:"actor" bson:"actor"`
+	Action           string                 `json:"action" bson:"action"`
+	TargetType       string                 `json:"targetType" bson:"targetType"`
+	TargetID         string                 `json:"targetId" bson:"targetId"`
+	IP               string                 `json:"ip" bson:"ip"`
+	UserAgent        string                 `json:"userAgent" bson:"userAgent"`
+	Before           map[string]interface{} `json:"before,omitempty" bson:"before,omitempty"`
+	After            map[string]interface{} `json:"after,omitempty" bson:"after,omitempty"`
+}
+
+//ContestMilestone a dated step of a contest timeline
+type ContestMilestone struct {
+	Title string    `json:"title" bson:"title"`
+	Date  time.Time `json:"date" bson:"date"`
+}
+
+//SubmissionWindow when a contest takes uploads, uploads are still accepted
+//for GracePeriodMinutes after ClosesAt
+type SubmissionWindow struct {
+	OpensAt            time.Time `json:"opensAt" bson:"opensAt"`
+	ClosesAt           time.Time `json:"closesAt" bson:"closesAt"`
+	GracePeriodMinutes int       `json:"gracePeriodMinutes" bson:"gracePeriodMinutes"`
+}
+
+//JudgingSetting how contestants of a contest are spread over judges
+type JudgingSetting struct {
+	JudgesPerContestant int `json:"judgesPerContestant" bson:"judgesPerContestant"`
+	MaxPerJudge         int `json:"maxPerJudge" bson:"maxPerJudge"`
+}
+
+//Contest a competition that contestants, galleries and carousels belong to
+type Contest struct {
+	mgm.DefaultModel   `bson:",inline"`
+	Name               string             `json:"name" bson:"name"`
+	Slug               string             `json:"slug" bson:"slug"`
+	Description        string             `json:"description" bson:"description"`
+	Rules              string             `json:"rules" bson:"rules"`
+	Timeline           []ContestMilestone `json:"timeline" bson:"timeline"`
+	Window             *SubmissionWindow  `json:"window" bson:"window"`
+	Judging            *JudgingSetting    `json:"judging" bson:"judging"`
+	ScoreMode          string             `json:"scoreMode" bson:"scoreMode"`
+	LeaderboardHidden  bool               `json:"leaderboardHidden" bson:"leaderboardHidden"`
+	ResultsPublishedAt *time.Time         `json:"resultsPublishedAt" bson:"resultsPublishedAt"`
+	CreatedBy          string             `json:"createdBy" bson:"createdBy"`
+	ArchivedAt         *time.Time         `json:"archivedAt" bson:"archivedAt"`
+}
+
+//RubricCriterion a weighted criterion judges give MinPoints to MaxPoints for
+type RubricCriterion struct {
+	Key         string  `json:"key" bson:"key"`
+	Name        string  `json:"name" bson:"name"`
+	Description string  `json:"description" bson:"description"`
+	Weight      float64 `json:"weight" bson:"weight"`
+	MinPoints   float64 `json:"minPoints" bson:"minPoints"`
+	MaxPoints   float64 `json:"maxPoints" bson:"maxPoints"`
+}
+
+//Rubric criteria the contestants of a contest are scored with, one per
+//contest
+type Rubric struct {
+	mgm.DefaultModel `bson:",inline"`
+	ContestID        primitive.ObjectID `json:"contestId" bson:"contestId"`
+	Criteria         []RubricCriterion  `json:"criteria" bson:"criteria"`
+	UpdatedBy        string             `json:"updatedBy" bson:"updatedBy"`
+}
+
+//Score points a judge gave a contestant, one per judge and contestant
+type Score struct {
+	mgm.DefaultModel `bson:",inline"`
+	ContestID        primitive.ObjectID `json:"contestId" bson:"contestId"`
+	ContestantID     primitive.ObjectID `json:"contestantId" bson:"contestantId"`
+	Judge            string             `json:"judge" bson:"judge"`
+	Points           map[string]float64 `json:"points" bson:"points"`
+	Total            float64            `json:"total" bson:"total"`
+	SubmittedAt      time.Time          `json:"submittedAt" bson:"submittedAt"`
+}
+
+//Assignment a contestant handed to a judge, done once the judge scored it
+type Assignment struct {
+	mgm.DefaultModel `bson:",inline"`
+	ContestID        primitive.ObjectID `json:"contestId" bson:"contestId"`
+	ContestantID     primitive.ObjectID `json:"contestantId" bson:"contestantId"`
+	Judge            string             `json:"judge" bson:"judge"`
+	Status           string             `json:"status" bson:"status"`
+	AssignedBy       string             `json:"assignedBy" bson:"assignedBy"`
+	CompletedAt      *time.Time         `json:"completedAt" bson:"completedAt"`
+}
+
+//ConflictException lets a judge handle a contestant despite a conflict of
+//interest, kept after revocation as a trail
+type ConflictException struct {
+	mgm.DefaultModel `bson:",inline"`
+	ContestID        primitive.ObjectID `json:"contestId" bson:"contestId"`
+	ContestantID     primitive.ObjectID `json:"contestantId" bson:"contestantId"`
+	Judge            string             `json:"judge" bson:"judge"`
+	Reason           string             `json:"reason" bson:"reason"`
+	GrantedBy        string             `json:"grantedBy" bson:"grantedBy"`
+	RevokedAt        *time.Time         `json:"revokedAt" bson:"revokedAt"`
+	RevokedBy        string             `json:"revokedBy" bson:"revokedBy"`
+}
+
+//Annotation note of a judge at a moment of the video of a contestant
+type Annotation struct {
+	mgm.DefaultModel `bson:",inline"`
+	ContestID        primitive.ObjectID `json:"contestId" bson:"contestId"`
+	ContestantID     primitive.ObjectID `json:"contestantId" bson:"contestantId"`
+	Author           string             `json:"author" bson:"author"`
+	Offset           int                `json:"offset" bson:"offset"`
+	Timestamp        string             `json:"timestamp" bson:"-"`
+	Text             string             `json:"text" bson:"text"`
+	Visibility       string             `json:"visibility" bson:"visibility"`
+}
+
+//Vote public vote for a contestant, one per verified email or phone per
+//contest
+type Vote struct {
+	mgm.DefaultModel `bson:",inline"`
+	ContestID        primitive.ObjectID `json:"contestId" bson:"contestId"`
+	ContestantID     primitive.ObjectID `json:"contestantId" bson:"contestantId"`
+	Channel          string             `json:"channel" bson:"channel"`
+	Voter            string             `json:"voter" bson:"voter"`
+	IP               string             `json:"ip" bson:"ip"`
+	Fingerprint      string             `json:"fingerprint" bson:"fingerprint"`
+	UserAgent        string             `json:"userAgent" bson:"userAgent"`
+	Status           string             `json:"status" bson:"status"`
+	Flags            []string           `json:"flags" bson:"flags"`
+	ReviewedBy       string             `json:"reviewedBy" bson:"reviewedBy"`
+	ReviewedAt       *time.Time         `json:"reviewedAt" bson:"reviewedAt"`
 }
 
 //Uploader carousel uploader data
@@ -65,8 +253,9 @@ type Content struct {
 //Carousel mongodb carousel model
 type Carousel struct {
 	mgm.DefaultModel `bson:",inline"`
-	Uploader         *Uploader `json:"uploader" bson:"uploader"`
-	Content          *Content  `json:"content" bson:"content"`
+	ContestID        primitive.ObjectID `json:"contestId" bson:"contestId"`
+	Uploader         *Uploader          `json:"uploader" bson:"uploader"`
+	Content          *Content           `json:"content" bson:"content"`
 }
 
 //ContentGallery gallery content data
@@ -80,8 +269,9 @@ type ContentGallery struct {
 //Gallery mongodb gallery model
 type Gallery struct {
 	mgm.DefaultModel `bson:",inline"`
-	Uploader         *Uploader       `json:"uploader" bson:"uploader"`
-	Content          *ContentGallery `json:"content" bson:"content"`
+	ContestID        primitive.ObjectID `json:"contestId" bson:"contestId"`
+	Uploader         *Uploader          `json:"uploader" bson:"uploader"`
+	Content          *ContentGallery    `json:"content" bson:"content"`
 }
 
 //ContestantVideo constant video info for google drive
@@ -90,15 +280,33 @@ type ContestantVideo struct {
 	ID  string `json:"id" bson:"id"`
 }
 
+//ContestantTransition a recorded move of a contestant between workflow
+//states
+type ContestantTransition struct {
+	From   string    `json:"from" bson:"from"`
+	To     string    `json:"to" bson:"to"`
+	Reason string    `json:"reason" bson:"reason"`
+	By     string    `json:"by" bson:"by"`
+	At     time.Time `json:"at" bson:"at"`
+}
+
 //Contestant mongodb contestant model
 type Contestant struct {
-	mgm.DefaultModel `bson:",inline"`
-	Name             string           `json:"name" bson:"name"`
-	Email            string           `json:"email" bson:"email"`
-	Phone            string           `json:"phone" bson:"phone"`
-	School           string           `json:"school" bson:"school"`
-	Title            string           `json:"title" bson:"title"`
-	Video            *ContestantVideo `json:"video" bson:"video"`
+	mgm.DefaultModel      `bson:",inline"`
+	ContestID             primitive.ObjectID     `json:"contestId" bson:"contestId"`
+	Name                  string                 `json:"name" bson:"name"`
+	Email                 string                 `json:"email" bson:"email"`
+	Phone                 string                 `json:"phone" bson:"phone"`
+	School                string                 `json:"school" bson:"school"`
+	Title                 string                 `json:"title" bson:"title"`
+	Video                 *ContestantVideo       `json:"video" bson:"video"`
+	EmailVerifiedAt       *time.Time             `json:"emailVerifiedAt" bson:"emailVerifiedAt"`
+	VerificationExpiresAt *time.Time             `json:"verificationExpiresAt" bson:"verificationExpiresAt"`
+	PhoneVerifiedAt       *time.Time             `json:"phoneVerifiedAt" bson:"phoneVerifiedAt"`
+	Status                string                 `json:"status" bson:"status"`
+	StatusReason          string                 `json:"statusReason" bson:"statusReason"`
+	StatusChangedAt       *time.Time             `json:"statusChangedAt" bson:"statusChangedAt"`
+	StatusHistory         []ContestantTransition `json:"statusHistory" bson:"statusHistory"`
 }
 
 //MongoDBInitialize init mongo db connection
@@ -142,3 +350,57 @@ func MongoDBInitialize(mongoDBConfig MongoDBConfig) {
 	}
 
 }
+
+//seedSuperadmin make username the first superadmin, nothing happens once a
+//superadmin exists
+func seedSuperadmin(username string, password string) error {
+	if username == "" {
+		return nil
+	}
+
+	count, err := mgm.Coll(&Admin{}).CountDocuments(mgm.Ctx(), bson.M{"role": adminRoleSuperadmin})
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	admin := &Admin{}
+	err = mgm.Coll(admin).First(bson.M{"username": username}, admin)
+	if err == nil {
+		admin.Role = adminRoleSuperadmin
+		admin.IsActive = true
+		if err := mgm.Coll(admin).Update(admin); err != nil {
+			return err
+		}
+
+		log.Printf("promoted %s to superadmin", username)
+		return nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return err
+	}
+
+	if e := validatePasswordPolicy("superadmin.password", password, username); len(e) != 0 {
+		return fmt.Errorf("superadmin password rejected: %v", e)
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	admin = &Admin{
+		Name:     username,
+		Username: username,
+		Password: hash,
+		IsActive: true,
+		Role:     adminRoleSuperadmin,
+	}
+	if err := mgm.Coll(admin).Create(admin); err != nil {
+		return err
+	}
+
+	log.Printf("created superadmin %s", username)
+	return nil
+}
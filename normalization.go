@@ -0,0 +1,296 @@
+// Copyright (C) 2021 Administrator
+//
+// This file is part of backend.
+//
+// backend is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// backend is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with backend.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/kamva/mgm/v3"
+	"github.com/thedevsaddam/govalidator"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	//scoreModeRaw mean of the totals
+	scoreModeRaw = "raw"
+	//scoreModeZScore mean of the totals turned into z-scores against all
+	//totals of the same judge, so lenient and strict judges weigh the same
+	scoreModeZScore = "zscore"
+	//scoreModeTrimmed mean of the totals without the highest and lowest one,
+	//contestants with fewer than 3 scores keep the plain mean
+	scoreModeTrimmed = "trimmed"
+)
+
+var scoreModes = []string{scoreModeRaw, scoreModeZScore, scoreModeTrimmed}
+
+func isScoreMode(mode string) bool {
+	for _, m := range scoreModes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+func mean(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+
+	var sum float64
+	for _, value := range values {
+		sum += value
+	}
+	return sum / float64(len(values))
+}
+
+//stddev population standard deviation of values
+func stddev(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+
+	m := mean(values)
+	var sum float64
+	for _, value := range values {
+		sum += (value - m) * (value - m)
+	}
+	return math.Sqrt(sum / float64(len(values)))
+}
+
+//normalizedScores final score of every scored contestant under mode
+func normalizedScores(scores []Score, mode string) map[primitive.ObjectID]float64 {
+	values := map[primitive.ObjectID][]float64{}
+
+	switch mode {
+	case scoreModeZScore:
+		byJudge := map[string][]float64{}
+		for _, score := range scores {
+			byJudge[score.Judge] = append(byJudge[score.Judge], score.Total)
+		}
+
+		for _, score := range scores {
+			totals := byJudge[score.Judge]
+
+			// a judge who gave everyone the same total says nothing about
+			// how contestants compare, that counts as average
+			z := 0.0
+			if sd := stddev(totals); sd > 0 {
+				z = (score.Total - mean(totals)) / sd
+			}
+			values[score.ContestantID] = append(values[score.ContestantID], z)
+		}
+	default:
+		for _, score := range scores {
+			values[score.ContestantID] = append(values[score.ContestantID], score.Total)
+		}
+	}
+
+	finals := map[primitive.ObjectID]float64{}
+	for contestantID, totals := range values {
+		if mode == scoreModeTrimmed && len(totals) >= 3 {
+			sorted := append([]float64{}, totals...)
+			sort.Float64s(sorted)
+			totals = sorted[1 : len(sorted)-1]
+		}
+		finals[contestantID] = mean(totals)
+	}
+
+	return finals
+}
+
+//sameScore whether two final scores tie, ignoring floating point noise
+func sameScore(a float64, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+//rankResults standard competition ranking of results sorted highest first,
+//ties share a rank and the next rank skips ahead (1, 2, 2, 4)
+func rankResults(results []*contestantResult) {
+	for i, result := range results {
+		if result.Judges == 0 {
+			result.Rank = 0
+			continue
+		}
+
+		if i > 0 && results[i-1].Judges != 0 && sameScore(results[i-1].FinalScore, result.FinalScore) {
+			result.Rank = results[i-1].Rank
+		} else {
+			result.Rank = i + 1
+		}
+	}
+}
+
+//compareScoreModes rank of every contestant under each mode side by side,
+//ordered by the mode of the contest, so admins see what a mode changes
+//before results are published
+func compareScoreModes(rw http.ResponseWriter, r *http.Request) {
+	result := &HTTPResponse{}
+
+	contest := contestFromVars(rw, r, result)
+	if contest == nil {
+		return
+	}
+
+	contestants, scores, err := contestScoringData(contest.ID)
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	current := contest.ScoreMode
+	if current == "" {
+		current = scoreModeRaw
+	}
+
+	type modeResult struct {
+		FinalScore float64 `json:"finalScore"`
+		Rank       int     `json:"rank"`
+	}
+	type comparison struct {
+		ContestantID primitive.ObjectID     `json:"contestantId"`
+		Name         string                 `json:"name"`
+		Title        string                 `json:"title"`
+		Judges       int                    `json:"judges"`
+		Modes        map[string]*modeResult `json:"modes"`
+		RankSpread   int                    `json:"rankSpread"`
+	}
+
+	ordered := []*comparison{}
+	byContestant := map[primitive.ObjectID]*comparison{}
+
+	for _, result := range aggregateScores(contestants, scores, current) {
+		entry := &comparison{
+			ContestantID: result.ContestantID,
+			Name:         result.Name,
+			Title:        result.Title,
+			Judges:       result.Judges,
+			Modes:        map[string]*modeResult{},
+		}
+		ordered = append(ordered, entry)
+		byContestant[result.ContestantID] = entry
+	}
+
+	for _, mode := range scoreModes {
+		for _, result := range aggregateScores(contestants, scores, mode) {
+			byContestant[result.ContestantID].Modes[mode] = &modeResult{
+				FinalScore: result.FinalScore,
+				Rank:       result.Rank,
+			}
+		}
+	}
+
+	for _, entry := range ordered {
+		if entry.Judges == 0 {
+			continue
+		}
+
+		lowest, highest := math.MaxInt32, 0
+		for _, m := range entry.Modes {
+			if m.Rank < lowest {
+				lowest = m.Rank
+			}
+			if m.Rank > highest {
+				highest = m.Rank
+			}
+		}
+		entry.RankSpread = highest - lowest
+	}
+
+	result.Data, err = json.Marshal(map[string]interface{}{
+		"mode":  current,
+		"modes": scoreModes,
+		"data":  ordered,
+	})
+	if err != nil {
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	result.Status = true
+
+	json.NewEncoder(rw).Encode(result)
+	return
+}
+
+//updateScoreMode choose the mode final scores of a contest are computed in
+func updateScoreMode(rw http.ResponseWriter, r *http.Request) {
+	result := &HTTPResponse{}
+
+	mapMode := &struct {
+		Mode string `json:"mode"`
+	}{}
+
+	rules := govalidator.MapData{
+		"mode": []string{"required", fmt.Sprintf("in:%s", strings.Join(scoreModes, ","))},
+	}
+
+	opts := govalidator.Options{
+		Request: r,
+		Data:    mapMode,
+		Rules:   rules,
+	}
+
+	v := govalidator.New(opts)
+	if e := v.ValidateJSON(); len(e) != 0 {
+		result.ValidationError = e
+
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	contest := contestFromVars(rw, r, result)
+	if contest == nil {
+		return
+	}
+
+	before := *contest
+	contest.ScoreMode = mapMode.Mode
+
+	err := mgm.Coll(contest).Update(contest)
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	recordAudit(r, "contest.update_score_mode", auditTargetContest, contest.ID.Hex(), before, contest)
+
+	// every final score may change, the ranking is rebuilt on the next read
+	clearLeaderboard(contest.ID, leaderboardScores)
+
+	result.Data, err = json.Marshal(contest)
+	if err != nil {
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	result.Status = true
+
+	json.NewEncoder(rw).Encode(result)
+	return
+}
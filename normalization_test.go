@@ -0,0 +1,153 @@
+// Copyright (C) 2021 Administrator
+//
+// This file is part of backend.
+//
+// backend is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// backend is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with backend.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"math"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestNormalizedScores(t *testing.T) {
+	a, b, c := primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID()
+
+	score := func(contestant primitive.ObjectID, judge string, total float64) Score {
+		return Score{ContestantID: contestant, Judge: judge, Total: total}
+	}
+
+	tests := []struct {
+		name   string
+		mode   string
+		scores []Score
+		want   map[primitive.ObjectID]float64
+	}{
+		{
+			name:   "raw is the plain mean",
+			mode:   scoreModeRaw,
+			scores: []Score{score(a, "j1", 10), score(a, "j2", 50), score(a, "j3", 60), score(a, "j4", 200), score(b, "j1", 40)},
+			want:   map[primitive.ObjectID]float64{a: 80, b: 40},
+		},
+		{
+			name:   "unknown mode falls back to raw",
+			mode:   "",
+			scores: []Score{score(a, "j1", 10), score(a, "j2", 30)},
+			want:   map[primitive.ObjectID]float64{a: 20},
+		},
+		{
+			name: "trimmed drops the highest and lowest from 3 scores on",
+			mode: scoreModeTrimmed,
+			scores: []Score{
+				score(a, "j1", 10), score(a, "j2", 50), score(a, "j3", 60), score(a, "j4", 200),
+				score(b, "j1", 40), score(b, "j2", 90),
+				score(c, "j1", 90), score(c, "j2", 10), score(c, "j3", 20),
+			},
+			want: map[primitive.ObjectID]float64{a: 55, b: 65, c: 20},
+		},
+		{
+			name: "zscore weighs judges alike",
+			mode: scoreModeZScore,
+			scores: []Score{
+				score(a, "lenient", 95), score(b, "lenient", 85),
+				score(a, "strict", 30), score(b, "strict", 50),
+			},
+			want: map[primitive.ObjectID]float64{a: 0, b: 0},
+		},
+		{
+			name: "zscore counts a judge without spread as average",
+			mode: scoreModeZScore,
+			scores: []Score{
+				score(a, "j1", 80), score(b, "j1", 60),
+				score(a, "j2", 50), score(b, "j2", 50),
+			},
+			want: map[primitive.ObjectID]float64{a: 0.5, b: -0.5},
+		},
+		{
+			name:   "zscore of a single score is zero",
+			mode:   scoreModeZScore,
+			scores: []Score{score(a, "j1", 70)},
+			want:   map[primitive.ObjectID]float64{a: 0},
+		},
+		{
+			name:   "no scores",
+			mode:   scoreModeTrimmed,
+			scores: []Score{},
+			want:   map[primitive.ObjectID]float64{},
+		},
+	}
+
+	for _, tt := range tests {
+		got := normalizedScores(tt.scores, tt.mode)
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got %d contestants, want %d", tt.name, len(got), len(tt.want))
+			continue
+		}
+		for id, want := range tt.want {
+			if final, ok := got[id]; !ok || math.Abs(final-want) > 1e-9 {
+				t.Errorf("%s: contestant %s = %v, want %v", tt.name, id.Hex(), final, want)
+			}
+		}
+	}
+}
+
+func TestRankResults(t *testing.T) {
+	result := func(final float64, judges int) *contestantResult {
+		return &contestantResult{FinalScore: final, Judges: judges}
+	}
+
+	tests := []struct {
+		name    string
+		results []*contestantResult
+		want    []int
+	}{
+		{
+			name:    "distinct scores",
+			results: []*contestantResult{result(90, 3), result(80, 3), result(70, 3)},
+			want:    []int{1, 2, 3},
+		},
+		{
+			name:    "ties share a rank and the next skips ahead",
+			results: []*contestantResult{result(90, 3), result(80, 3), result(80, 3), result(70, 3)},
+			want:    []int{1, 2, 2, 4},
+		},
+		{
+			name:    "tie at the top",
+			results: []*contestantResult{result(90, 3), result(90, 3), result(90, 3), result(10, 3)},
+			want:    []int{1, 1, 1, 4},
+		},
+		{
+			name:    "floating point noise still ties",
+			results: []*contestantResult{result(0.1+0.2, 2), result(0.3, 2)},
+			want:    []int{1, 1},
+		},
+		{
+			name:    "unscored contestants have no rank",
+			results: []*contestantResult{result(50, 1), result(0, 0), result(0, 0)},
+			want:    []int{1, 0, 0},
+		},
+	}
+
+	for _, tt := range tests {
+		rankResults(tt.results)
+		for i, want := range tt.want {
+			if tt.results[i].Rank != want {
+				t.Errorf("%s: result %d rank = %d, want %d", tt.name, i, tt.results[i].Rank, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,436 @@
+// Copyright (C) 2021 Administrator
+//
+// This file is part of backend.
+//
+// backend is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// backend is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with backend.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc"
+	"github.com/go-redis/redis/v7"
+	"github.com/kamva/mgm/v3"
+	"github.com/thedevsaddam/govalidator"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/oauth2"
+)
+
+const oidcStateTTL = 10 * time.Minute
+
+var (
+	oidcMu       sync.Mutex
+	oidcProvider *oidc.Provider
+
+	nonAlphaNum = regexp.MustCompile(`[^a-z0-9]`)
+)
+
+//errOIDCDisabled returned when no identity provider is configured
+var errOIDCDisabled = errors.New("Single sign-on is not configured")
+
+func oidcStateKey(state string) string {
+	return fmt.Sprintf("oidc-state:%s", state)
+}
+
+//getOIDCProvider discover the configured identity provider, the result is
+//cached once discovery succeeds so a provider that is down at startup does
+//not keep the server from starting
+func getOIDCProvider(ctx context.Context) (*oidc.Provider, error) {
+	if cfg.OIDC.Issuer == "" {
+		return nil, errOIDCDisabled
+	}
+
+	oidcMu.Lock()
+	defer oidcMu.Unlock()
+
+	if oidcProvider != nil {
+		return oidcProvider, nil
+	}
+
+	provider, err := oidc.NewProvider(ctx, cfg.OIDC.Issuer)
+	if err != nil {
+		return nil, err
+	}
+	oidcProvider = provider
+
+	return oidcProvider, nil
+}
+
+func oauth2Config(provider *oidc.Provider) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     cfg.OIDC.ClientID,
+		ClientSecret: cfg.OIDC.ClientSecret,
+		RedirectURL:  cfg.OIDC.RedirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       []string{oidc.ScopeOpenID, "profile", "email"},
+	}
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+//redeemOIDCState consume a login state, returns the nonce it was issued with
+//or empty when it is unknown, expired or already used
+func redeemOIDCState(state string) (string, error) {
+	nonce, err := redisClient.Get(oidcStateKey(state)).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	deleted, err := redisClient.Del(oidcStateKey(state)).Result()
+	if err != nil {
+		return "", err
+	}
+	if deleted == 0 {
+		return "", nil
+	}
+
+	return nonce, nil
+}
+
+//isAllowedEmailDomain whether email belongs to one of the configured
+//domains, NewConfig refuses single sign-on without any
+func isAllowedEmailDomain(email string) bool {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return false
+	}
+	domain := email[at+1:]
+
+	for _, allowed := range cfg.OIDC.AllowedDomains {
+		if strings.EqualFold(domain, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+//uniqueUsername derive an unused username from the local part of email
+func uniqueUsername(email string) (string, error) {
+	base := nonAlphaNum.ReplaceAllString(strings.ToLower(strings.SplitN(email, "@", 2)[0]), "")
+	if len(base) < 3 {
+		base = "admin" + base
+	}
+	if len(base) > 12 {
+		base = base[:12]
+	}
+
+	for i := 0; i < 100; i++ {
+		username := base
+		if i > 0 {
+			username = fmt.Sprintf("%s%d", base, i)
+		}
+
+		count, err := mgm.Coll(&Admin{}).CountDocuments(mgm.Ctx(), bson.M{"username": username})
+		if err != nil {
+			return "", err
+		}
+		if count == 0 {
+			return username, nil
+		}
+	}
+
+	return "", fmt.Errorf("no free username for %s", email)
+}
+
+//findOIDCAdmin find the admin linked to the identity, an admin found by
+//email gets linked on first sign in and an unknown identity is provisioned
+//as an inactive admin waiting for a superadmin to activate it
+func findOIDCAdmin(subject string, email string, name string) (*Admin, error) {
+	admin := &Admin{}
+
+	err := mgm.Coll(admin).First(bson.M{"oidcSubject": subject}, admin)
+	if err == nil {
+		return admin, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+
+	err = mgm.Coll(admin).First(bson.M{"email": email}, admin)
+	if err == nil {
+		if admin.OIDCSubject != "" && admin.OIDCSubject != subject {
+			return nil, nil
+		}
+
+		admin.OIDCSubject = subject
+		err = mgm.Coll(admin).Update(admin)
+		if err != nil {
+			return nil, err
+		}
+		return admin, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+
+	username, err := uniqueUsername(email)
+	if err != nil {
+		return nil, err
+	}
+
+	// the account can only sign in through the provider until a password
+	// reset sets a real one
+	secret, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	hash, err := hashPassword(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	if name == "" {
+		name = username
+	}
+
+	admin = &Admin{
+		Name:        name,
+		Username:    username,
+		Email:       email,
+		Password:    hash,
+		IsActive:    false,
+		Role:        adminRoleAdmin,
+		OIDCSubject: subject,
+	}
+
+	err = mgm.Coll(admin).Create(admin)
+	if err != nil {
+		return nil, err
+	}
+
+	return admin, nil
+}
+
+func adminOIDCLogin(rw http.ResponseWriter, r *http.Request) {
+	result := &HTTPResponse{}
+
+	provider, err := getOIDCProvider(r.Context())
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	state, err := randomToken()
+	if err != nil {
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	nonce, err := randomToken()
+	if err != nil {
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	err = redisClient.Set(oidcStateKey(state), nonce, oidcStateTTL).Err()
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	authURL := oauth2Config(provider).AuthCodeURL(state, oidc.Nonce(nonce))
+
+	result.Data, err = json.Marshal(map[string]interface{}{
+		"authUrl": authURL,
+		"state":   state,
+	})
+	if err != nil {
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	result.Status = true
+
+	json.NewEncoder(rw).Encode(result)
+	return
+}
+
+func adminOIDCCallback(rw http.ResponseWriter, r *http.Request) {
+	result := &HTTPResponse{}
+
+	mapCallback := &struct {
+		Code  string `json:"code"`
+		State string `json:"state"`
+	}{}
+
+	rules := govalidator.MapData{
+		"code":  []string{"required"},
+		"state": []string{"required"},
+	}
+
+	opts := govalidator.Options{
+		Request: r,
+		Data:    mapCallback,
+		Rules:   rules,
+	}
+
+	v := govalidator.New(opts)
+	if e := v.ValidateJSON(); len(e) != 0 {
+		result.ValidationError = e
+
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	provider, err := getOIDCProvider(r.Context())
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	nonce, err := redeemOIDCState(mapCallback.State)
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	if nonce == "" {
+		result.ErrorMsg = "Sign in request is invalid or expired"
+
+		rw.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	oauth2Token, err := oauth2Config(provider).Exchange(r.Context(), mapCallback.Code)
+	if err != nil {
+		logSecurityEvent(r, "oidc_exchange_failed", "error=%q", err.Error())
+
+		result.ErrorMsg = "Sign in failed"
+		rw.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	rawIDToken, ok := oauth2Token.Extra("id_token").(string)
+	if !ok {
+		result.ErrorMsg = "Sign in failed"
+
+		rw.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: cfg.OIDC.ClientID}).Verify(r.Context(), rawIDToken)
+	if err != nil || idToken.Nonce != nonce {
+		logSecurityEvent(r, "oidc_invalid_id_token", "subject=%s", idTokenSubject(idToken))
+
+		result.ErrorMsg = "Sign in failed"
+		rw.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	claims := &struct {
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+		Name          string `json:"name"`
+	}{}
+	if err := idToken.Claims(claims); err != nil {
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	email := strings.ToLower(claims.Email)
+
+	if email == "" || !claims.EmailVerified || !isAllowedEmailDomain(email) {
+		logSecurityEvent(r, "oidc_email_rejected", "subject=%s email=%s", idToken.Subject, email)
+
+		result.ErrorMsg = "This account is not allowed to sign in"
+		rw.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	admin, err := findOIDCAdmin(idToken.Subject, email, claims.Name)
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	if admin == nil {
+		logSecurityEvent(r, "oidc_unknown_account", "subject=%s email=%s", idToken.Subject, email)
+
+		result.ErrorMsg = "This account is not allowed to sign in"
+		rw.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	if !admin.IsActive {
+		result.ErrorMsg = "Account is waiting for activation by a superadmin"
+
+		rw.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	logSecurityEvent(r, "oidc_login", "username=%s subject=%s", admin.Username, idToken.Subject)
+
+	data, err := adminLoginData(admin, r)
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	result.Data, err = json.Marshal(data)
+	if err != nil {
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	result.Status = true
+
+	json.NewEncoder(rw).Encode(result)
+	return
+}
+
+func idTokenSubject(idToken *oidc.IDToken) string {
+	if idToken == nil {
+		return ""
+	}
+	return idToken.Subject
+}
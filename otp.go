@@ -0,0 +1,215 @@
+// Copyright (C) 2021 Administrator
+//
+// This file is part of backend.
+//
+// backend is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// backend is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with backend.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ttacon/libphonenumber"
+)
+
+const (
+	otpProviderLog     = "log"
+	otpProviderZenziva = "zenziva"
+	otpProviderWablas  = "wablas"
+	otpProviderFonnte  = "fonnte"
+
+	otpGatewayTimeout = 10 * time.Second
+)
+
+//OTPSender delivers one time codes to phone numbers
+type OTPSender interface {
+	Send(phone string, message string) error
+}
+
+var otpSender OTPSender
+
+var otpHTTPClient = &http.Client{Timeout: otpGatewayTimeout}
+
+//gatewayNumber number the way Indonesian gateways expect it, E.164 without
+//the plus, e.g. 6281234567890
+func gatewayNumber(phone string) (string, error) {
+	num, err := libphonenumber.Parse(phone, "ID")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimPrefix(libphonenumber.Format(num, libphonenumber.E164), "+"), nil
+}
+
+//postGateway post form to a gateway and decode its JSON reply into reply
+func postGateway(endpoint string, header http.Header, form url.Values, reply interface{}) error {
+	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header = header
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := otpHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("gateway %s replied %s", req.URL.Host, resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(reply)
+}
+
+//LogOTPSender only logs codes, for local development
+type LogOTPSender struct{}
+
+//Send log the message instead of sending it
+func (LogOTPSender) Send(phone string, message string) error {
+	log.Printf("[OTP] to=%s message=%q", phone, message)
+	return nil
+}
+
+//ZenzivaSender send codes as SMS through Zenziva
+type ZenzivaSender struct {
+	URL     string
+	UserKey string
+	PassKey string
+}
+
+//Send send an SMS
+func (s ZenzivaSender) Send(phone string, message string) error {
+	to, err := gatewayNumber(phone)
+	if err != nil {
+		return err
+	}
+
+	reply := &struct {
+		Status string `json:"status"`
+		Text   string `json:"text"`
+	}{}
+	err = postGateway(s.URL, http.Header{}, url.Values{
+		"userkey": []string{s.UserKey},
+		"passkey": []string{s.PassKey},
+		"to":      []string{to},
+		"message": []string{message},
+	}, reply)
+	if err != nil {
+		return err
+	}
+	if reply.Status != "1" {
+		return fmt.Errorf("zenziva: %s", reply.Text)
+	}
+
+	return nil
+}
+
+//WablasSender send codes as WhatsApp messages through Wablas
+type WablasSender struct {
+	Host  string
+	Token string
+}
+
+//Send send a WhatsApp message
+func (s WablasSender) Send(phone string, message string) error {
+	to, err := gatewayNumber(phone)
+	if err != nil {
+		return err
+	}
+
+	reply := &struct {
+		Status  bool   `json:"status"`
+		Message string `json:"message"`
+	}{}
+	err = postGateway(strings.TrimSuffix(s.Host, "/")+"/api/send-message", http.Header{
+		"Authorization": []string{s.Token},
+	}, url.Values{
+		"phone":   []string{to},
+		"message": []string{message},
+	}, reply)
+	if err != nil {
+		return err
+	}
+	if !reply.Status {
+		return fmt.Errorf("wablas: %s", reply.Message)
+	}
+
+	return nil
+}
+
+//FonnteSender send codes as WhatsApp messages through Fonnte
+type FonnteSender struct {
+	URL   string
+	Token string
+}
+
+//Send send a WhatsApp message
+func (s FonnteSender) Send(phone string, message string) error {
+	to, err := gatewayNumber(phone)
+	if err != nil {
+		return err
+	}
+
+	reply := &struct {
+		Status bool   `json:"status"`
+		Reason string `json:"reason"`
+	}{}
+	err = postGateway(s.URL, http.Header{
+		"Authorization": []string{s.Token},
+	}, url.Values{
+		"target":  []string{to},
+		"message": []string{message},
+	}, reply)
+	if err != nil {
+		return err
+	}
+	if !reply.Status {
+		return fmt.Errorf("fonnte: %s", reply.Reason)
+	}
+
+	return nil
+}
+
+//newOTPSender sender of the configured provider
+func newOTPSender(config Config) (OTPSender, error) {
+	switch config.OTP.Provider {
+	case "", otpProviderLog:
+		return LogOTPSender{}, nil
+	case otpProviderZenziva:
+		return ZenzivaSender{
+			URL:     config.OTP.Zenziva.URL,
+			UserKey: config.OTP.Zenziva.UserKey,
+			PassKey: config.OTP.Zenziva.PassKey,
+		}, nil
+	case otpProviderWablas:
+		return WablasSender{
+			Host:  config.OTP.Wablas.Host,
+			Token: config.OTP.Wablas.Token,
+		}, nil
+	case otpProviderFonnte:
+		return FonnteSender{
+			URL:   config.OTP.Fonnte.URL,
+			Token: config.OTP.Fonnte.Token,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown otp provider '%s'", config.OTP.Provider)
+}
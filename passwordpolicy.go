@@ -0,0 +1,150 @@
+// Copyright (C) 2021 Administrator
+//
+// This file is part of backend.
+//
+// backend is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// backend is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with backend.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+//BreachedPasswords SHA-1 hashes of known breached passwords, bucketed by
+//their 5 character prefix like the Have I Been Pwned range API
+type BreachedPasswords struct {
+	ranges map[string]map[string]struct{}
+}
+
+var breachedPasswords *BreachedPasswords
+
+//LoadBreachedPasswords load a file of uppercase SHA-1 hashes, one per line,
+//optionally followed by ":count" as in the Have I Been Pwned downloads
+func LoadBreachedPasswords(path string) (*BreachedPasswords, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	bp := &BreachedPasswords{
+		ranges: map[string]map[string]struct{}{},
+	}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		hash := strings.ToUpper(strings.SplitN(line, ":", 2)[0])
+		if len(hash) != 40 {
+			return nil, fmt.Errorf("'%s' is not a SHA-1 hash list", path)
+		}
+
+		prefix, suffix := hash[:5], hash[5:]
+		if bp.ranges[prefix] == nil {
+			bp.ranges[prefix] = map[string]struct{}{}
+		}
+		bp.ranges[prefix][suffix] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return bp, nil
+}
+
+//Contains whether password is in the breached list
+func (bp *BreachedPasswords) Contains(password string) bool {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	_, ok := bp.ranges[hash[:5]][hash[5:]]
+	return ok
+}
+
+//containsPersonal whether password contains any word of personal that is
+//at least 3 characters long
+func containsPersonal(password string, personal []string) bool {
+	lowered := strings.ToLower(password)
+
+	for _, value := range personal {
+		for _, part := range strings.Fields(strings.ToLower(value)) {
+			if utf8.RuneCountInString(part) >= 3 && strings.Contains(lowered, part) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+//validatePasswordPolicy check password against the configured policy, it
+//must not contain any of personal like the username or name, errors are
+//returned the same way govalidator does
+func validatePasswordPolicy(field string, password string, personal ...string) url.Values {
+	policy := cfg.PasswordPolicy
+	errs := url.Values{}
+
+	length := utf8.RuneCountInString(password)
+	if length < policy.MinLength || length > policy.MaxLength {
+		errs.Add(field, fmt.Sprintf("The %s field must be between %d and %d characters", field, policy.MinLength, policy.MaxLength))
+	}
+
+	var hasUpper, hasLower, hasDigit, hasSymbol bool
+	for _, c := range password {
+		switch {
+		case unicode.IsUpper(c):
+			hasUpper = true
+		case unicode.IsLower(c):
+			hasLower = true
+		case unicode.IsDigit(c):
+			hasDigit = true
+		case unicode.IsPunct(c) || unicode.IsSymbol(c) || unicode.IsSpace(c):
+			hasSymbol = true
+		}
+	}
+	if policy.RequireUpper && !hasUpper {
+		errs.Add(field, fmt.Sprintf("The %s field must contain an uppercase letter", field))
+	}
+	if policy.RequireLower && !hasLower {
+		errs.Add(field, fmt.Sprintf("The %s field must contain a lowercase letter", field))
+	}
+	if policy.RequireDigit && !hasDigit {
+		errs.Add(field, fmt.Sprintf("The %s field must contain a digit", field))
+	}
+	if policy.RequireSymbol && !hasSymbol {
+		errs.Add(field, fmt.Sprintf("The %s field must contain a symbol", field))
+	}
+
+	if containsPersonal(password, personal) {
+		errs.Add(field, fmt.Sprintf("The %s field must not contain your username or name", field))
+	}
+
+	if breachedPasswords != nil && breachedPasswords.Contains(password) {
+		errs.Add(field, fmt.Sprintf("The %s field is a known breached password, choose another one", field))
+	}
+
+	return errs
+}
@@ -0,0 +1,328 @@
+// Copyright (C) 2021 Administrator
+//
+// This file is part of backend.
+//
+// backend is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// backend is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with backend.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/kamva/mgm/v3"
+	"github.com/thedevsaddam/govalidator"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const passwordResetCooldown = time.Minute
+
+func passwordResetKey(tokenHash string) string {
+	return fmt.Sprintf("password-reset:%s", tokenHash)
+}
+
+func passwordResetAdminKey(username string) string {
+	return fmt.Sprintf("password-reset-admin:%s", username)
+}
+
+func passwordResetCooldownKey(email string) string {
+	return fmt.Sprintf("password-reset-cooldown:%s", strings.ToLower(email))
+}
+
+func hashResetToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+//createPasswordReset store a single use reset token for username, only its
+//hash is kept and any earlier token of the admin stops working
+func createPasswordReset(username string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+	tokenHash := hashResetToken(token)
+
+	previous, err := redisClient.Get(passwordResetAdminKey(username)).Result()
+	if err != nil && err != redis.Nil {
+		return "", err
+	}
+	if previous != "" {
+		redisClient.Del(passwordResetKey(previous))
+	}
+
+	err = redisClient.Set(passwordResetKey(tokenHash), username, cfg.PasswordReset.TTL).Err()
+	if err != nil {
+		return "", err
+	}
+	err = redisClient.Set(passwordResetAdminKey(username), tokenHash, cfg.PasswordReset.TTL).Err()
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+//redeemPasswordReset consume a reset token, returns the username it was
+//issued to or empty when it is unknown, expired or already used
+func redeemPasswordReset(token string) (string, error) {
+	tokenHash := hashResetToken(token)
+
+	username, err := redisClient.Get(passwordResetKey(tokenHash)).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// only the request that actually deletes the key may use it
+	deleted, err := redisClient.Del(passwordResetKey(tokenHash)).Result()
+	if err != nil {
+		return "", err
+	}
+	if deleted == 0 {
+		return "", nil
+	}
+	redisClient.Del(passwordResetAdminKey(username))
+
+	return username, nil
+}
+
+func passwordResetLink(token string) string {
+	link, err := url.Parse(cfg.PasswordReset.URL)
+	if err != nil {
+		return fmt.Sprintf("%s?token=%s", cfg.PasswordReset.URL, token)
+	}
+
+	query := link.Query()
+	query.Set("token", token)
+	link.RawQuery = query.Encode()
+
+	return link.String()
+}
+
+func adminForgotPassword(rw http.ResponseWriter, r *http.Request) {
+	result := &HTTPResponse{}
+
+	mapForgot := &struct {
+		Email string `json:"email"`
+	}{}
+
+	rules := govalidator.MapData{
+		"email": []string{"required", "email"},
+	}
+
+	opts := govalidator.Options{
+		Request: r,
+		Data:    mapForgot,
+		Rules:   rules,
+	}
+
+	v := govalidator.New(opts)
+	if e := v.ValidateJSON(); len(e) != 0 {
+		result.ValidationError = e
+
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	// the response is the same whether the email belongs to an admin or not
+	result.Status = true
+
+	fresh, err := redisClient.SetNX(passwordResetCooldownKey(mapForgot.Email), 1, passwordResetCooldown).Result()
+	if err != nil {
+		log.Println(err)
+	}
+	if !fresh {
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	admin := &Admin{}
+	err = mgm.Coll(admin).FindOne(
+		mgm.Ctx(),
+		bson.M{
+			"email": strings.ToLower(mapForgot.Email),
+		},
+	).Decode(&admin)
+	if err != nil || !admin.IsActive {
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	token, err := createPasswordReset(admin.Username)
+	if err != nil {
+		log.Println(err)
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	body := fmt.Sprintf(
+		"Hi %s,\n\n"+
+			"Someone asked to reset the password of your admin account %s.\n"+
+			"Open the link below within %s to choose a new password:\n\n"+
+			"%s\n\n"+
+			"If it was not you, ignore this email and your password stays the same.\n",
+		admin.Name,
+		admin.Username,
+		cfg.PasswordReset.TTL,
+		passwordResetLink(token),
+	)
+
+	go func(to string) {
+		if err := mailer.Send(to, "Reset your admin password", body); err != nil {
+			log.Println(err)
+		}
+	}(admin.Email)
+
+	json.NewEncoder(rw).Encode(result)
+	return
+}
+
+func adminResetPassword(rw http.ResponseWriter, r *http.Request) {
+	result := &HTTPResponse{}
+
+	mapReset := &struct {
+		Token          string `json:"token"`
+		Password       string `json:"password"`
+		PasswordVerify string `json:"verify"`
+	}{}
+
+	rules := govalidator.MapData{
+		"token":    []string{"required"},
+		"password": []string{"required"},
+		"verify":   []string{"required"},
+	}
+
+	opts := govalidator.Options{
+		Request: r,
+		Data:    mapReset,
+		Rules:   rules,
+	}
+
+	v := govalidator.New(opts)
+	if e := v.ValidateJSON(); len(e) != 0 {
+		result.ValidationError = e
+
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	if mapReset.Password != mapReset.PasswordVerify {
+		result.ErrorMsg = "Password and Verify Password not equal"
+
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	// the token is only consumed once the new password passes the policy
+	username, err := redisClient.Get(passwordResetKey(hashResetToken(mapReset.Token))).Result()
+	if err != nil && err != redis.Nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	if username == "" {
+		result.ErrorMsg = "Reset link is invalid or expired"
+
+		rw.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	admin := &Admin{}
+	err = mgm.Coll(admin).FindOne(
+		mgm.Ctx(),
+		bson.M{
+			"username": username,
+		},
+	).Decode(&admin)
+	if err != nil {
+		result.ErrorMsg = "Reset link is invalid or expired"
+
+		rw.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	if e := validatePasswordPolicy("password", mapReset.Password, admin.Username, admin.Name); len(e) != 0 {
+		result.ValidationError = e
+
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	redeemed, err := redeemPasswordReset(mapReset.Token)
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	if redeemed != admin.Username {
+		result.ErrorMsg = "Reset link is invalid or expired"
+
+		rw.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	hash, err := hashPassword(mapReset.Password)
+	if err != nil {
+		result.ErrorMsg = err.Error()
+
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	before := *admin
+	admin.Password = hash
+	admin.UpdatedAt = time.Now()
+
+	err = mgm.Coll(admin).Update(admin)
+	if err != nil {
+		result.ErrorMsg = err.Error()
+
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	err = revokeAllSessions(admin.Username, "")
+	if err != nil {
+		log.Println(err)
+	}
+	err = redisClient.Del(loginLockKey(admin.Username), loginFailUsernameKey(admin.Username)).Err()
+	if err != nil {
+		log.Println(err)
+	}
+
+	logSecurityEvent(r, "password_reset", "username=%s", admin.Username)
+	recordAuditAs(r, admin.Username, "admin.reset_password", auditTargetAdmin, admin.ID.Hex(), before, admin)
+
+	result.Status = true
+
+	json.NewEncoder(rw).Encode(result)
+	return
+}
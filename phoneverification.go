@@ -0,0 +1,342 @@
+// Copyright (C) 2021 Administrator
+//
+// This file is part of backend.
+//
+// backend is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// backend is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with backend.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/kamva/mgm/v3"
+	"github.com/thedevsaddam/govalidator"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	phoneCodeLength = 6
+	//phoneOTPWindow window the send and attempt limits are counted over
+	phoneOTPWindow = 24 * time.Hour
+
+	phoneOTPLimitMsg = "Too many codes requested, try again tomorrow"
+)
+
+func phoneOTPKey(contestantID primitive.ObjectID) string {
+	return fmt.Sprintf("phone-otp:%s", contestantID.Hex())
+}
+
+func phoneOTPAttemptsKey(contestantID primitive.ObjectID) string {
+	return fmt.Sprintf("phone-otp-attempts:%s", contestantID.Hex())
+}
+
+func phoneOTPCooldownKey(contestantID primitive.ObjectID) string {
+	return fmt.Sprintf("phone-otp-cooldown:%s", contestantID.Hex())
+}
+
+func phoneOTPSendsKey(contestantID primitive.ObjectID) string {
+	return fmt.Sprintf("phone-otp-sends:%s", contestantID.Hex())
+}
+
+func phoneOTPSendsIPKey(ip string) string {
+	return fmt.Sprintf("phone-otp-sends:ip:%s", ip)
+}
+
+//isPhoneOTPSendLimited whether the daily send limit of the client ip or the
+//contestant is used up, the request counts against both
+func isPhoneOTPSendLimited(r *http.Request, contestantID primitive.ObjectID) (bool, error) {
+	ipCount, err := incrementWindowFor(phoneOTPSendsIPKey(getClientIP(r)), phoneOTPWindow)
+	if err != nil {
+		return false, err
+	}
+	if ipCount > int64(cfg.OTP.MaxSendsPerIP) {
+		return true, nil
+	}
+
+	contestantCount, err := incrementWindowFor(phoneOTPSendsKey(contestantID), phoneOTPWindow)
+	if err != nil {
+		return false, err
+	}
+	return contestantCount > int64(cfg.OTP.MaxSendsPerDay), nil
+}
+
+//otpMessage text of a message carrying code that stays valid for ttl
+func otpMessage(code string, ttl time.Duration) string {
+	return fmt.Sprintf(
+		"%s: your verification code is %s, valid for %s. Never share this code.",
+		cfg.TOTP.Issuer,
+		code,
+		ttl,
+	)
+}
+
+//phoneContestant contestant named by id whose phone can still be verified,
+//otherwise the response is written and nil returned
+func phoneContestant(rw http.ResponseWriter, result *HTTPResponse, contestantID string) *Contestant {
+	contestant := &Contestant{}
+	id, err := primitive.ObjectIDFromHex(contestantID)
+	if err == nil {
+		err = mgm.Coll(contestant).FindByID(id, contestant)
+	}
+	if err != nil {
+		result.ErrorMsg = "Data Not Found"
+
+		rw.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(rw).Encode(result)
+		return nil
+	}
+
+	if contestant.PhoneVerifiedAt != nil {
+		result.ErrorMsg = "Phone is already verified"
+
+		rw.WriteHeader(http.StatusConflict)
+		json.NewEncoder(rw).Encode(result)
+		return nil
+	}
+	if contestant.State() == contestantExpired {
+		result.ErrorMsg = "Submission has expired"
+
+		rw.WriteHeader(http.StatusConflict)
+		json.NewEncoder(rw).Encode(result)
+		return nil
+	}
+
+	return contestant
+}
+
+//sendPhoneOTP send a code to the phone of a contestant, a new code
+//replaces the previous one, wrong attempts carry over
+func sendPhoneOTP(rw http.ResponseWriter, r *http.Request) {
+	result := &HTTPResponse{}
+
+	mapSend := &struct {
+		ContestantID string `json:"contestantId"`
+	}{}
+
+	rules := govalidator.MapData{
+		"contestantId": []string{"required"},
+	}
+
+	opts := govalidator.Options{
+		Request: r,
+		Data:    mapSend,
+		Rules:   rules,
+	}
+
+	v := govalidator.New(opts)
+	if e := v.ValidateJSON(); len(e) != 0 {
+		result.ValidationError = e
+
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	contestant := phoneContestant(rw, result, mapSend.ContestantID)
+	if contestant == nil {
+		return
+	}
+
+	fresh, err := redisClient.SetNX(phoneOTPCooldownKey(contestant.ID), 1, cfg.OTP.ResendCooldown).Result()
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	if !fresh {
+		wait, _ := redisClient.TTL(phoneOTPCooldownKey(contestant.ID)).Result()
+		result.ErrorMsg = fmt.Sprintf("A code was just sent, try again in %d seconds", int(wait.Seconds()))
+
+		rw.WriteHeader(http.StatusTooManyRequests)
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	limited, err := isPhoneOTPSendLimited(r, contestant.ID)
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	if limited {
+		logSecurityEvent(r, "phone_otp_send_limited", "contestant=%s", contestant.ID.Hex())
+
+		result.ErrorMsg = phoneOTPLimitMsg
+		rw.WriteHeader(http.StatusTooManyRequests)
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	code, err := randomDigits(phoneCodeLength)
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	err = redisClient.Set(phoneOTPKey(contestant.ID), hashResetToken(code), cfg.OTP.CodeTTL).Err()
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	go func(phone string) {
+		if err := otpSender.Send(phone, otpMessage(code, cfg.OTP.CodeTTL)); err != nil {
+			log.Println(err)
+		}
+	}(contestant.Phone)
+
+	result.Data, err = json.Marshal(map[string]interface{}{
+		"expiresIn":   int(cfg.OTP.CodeTTL.Seconds()),
+		"resendAfter": int(cfg.OTP.ResendCooldown.Seconds()),
+	})
+	if err != nil {
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	result.Status = true
+
+	json.NewEncoder(rw).Encode(result)
+	return
+}
+
+//verifyPhoneOTP check the code sent to the phone of a contestant, after
+//too many wrong codes in a day the code is dropped and every later wrong
+//code drops the next one
+func verifyPhoneOTP(rw http.ResponseWriter, r *http.Request) {
+	result := &HTTPResponse{}
+
+	mapVerify := &struct {
+		ContestantID string `json:"contestantId"`
+		Code         string `json:"code"`
+	}{}
+
+	rules := govalidator.MapData{
+		"contestantId": []string{"required"},
+		"code":         []string{"required", fmt.Sprintf("digits:%d", phoneCodeLength)},
+	}
+
+	opts := govalidator.Options{
+		Request: r,
+		Data:    mapVerify,
+		Rules:   rules,
+	}
+
+	v := govalidator.New(opts)
+	if e := v.ValidateJSON(); len(e) != 0 {
+		result.ValidationError = e
+
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	contestant := phoneContestant(rw, result, mapVerify.ContestantID)
+	if contestant == nil {
+		return
+	}
+
+	invalidCode := func() {
+		result.ValidationError = url.Values{
+			"code": []string{"The code is invalid or expired"},
+		}
+		json.NewEncoder(rw).Encode(result)
+	}
+
+	codeHash, err := redisClient.Get(phoneOTPKey(contestant.ID)).Result()
+	if err == redis.Nil {
+		invalidCode()
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashResetToken(mapVerify.Code)), []byte(codeHash)) != 1 {
+		attempts, err := incrementWindowFor(phoneOTPAttemptsKey(contestant.ID), phoneOTPWindow)
+		if err != nil {
+			log.Println(err)
+		}
+		if attempts >= int64(cfg.OTP.MaxAttempts) {
+			redisClient.Del(phoneOTPKey(contestant.ID))
+			logSecurityEvent(r, "phone_otp_exhausted", "contestant=%s", contestant.ID.Hex())
+
+			result.ErrorMsg = "Too many wrong codes, request a new one"
+			rw.WriteHeader(http.StatusTooManyRequests)
+			json.NewEncoder(rw).Encode(result)
+			return
+		}
+
+		invalidCode()
+		return
+	}
+
+	// only the request that actually deletes the code may use it
+	deleted, err := redisClient.Del(phoneOTPKey(contestant.ID)).Result()
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	if deleted == 0 {
+		invalidCode()
+		return
+	}
+	redisClient.Del(phoneOTPAttemptsKey(contestant.ID))
+
+	now := time.Now()
+	contestant.PhoneVerifiedAt = &now
+
+	// only the field is set, the workflow may have moved the contestant since
+	// it was read
+	_, err = mgm.Coll(contestant).UpdateOne(mgm.Ctx(), bson.M{"_id": contestant.ID}, bson.M{
+		"$set": bson.M{"phoneVerifiedAt": now, "updated_at": now},
+	})
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	result.Data, err = json.Marshal(map[string]interface{}{
+		"contestantId":    contestant.ID,
+		"phoneVerifiedAt": contestant.PhoneVerifiedAt,
+	})
+	if err != nil {
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	result.Status = true
+
+	json.NewEncoder(rw).Encode(result)
+	return
+}
@@ -22,7 +22,9 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
@@ -47,7 +49,8 @@ func createAdmin(rw http.ResponseWriter, r *http.Request) {
 	rules := govalidator.MapData{
 		"name":            []string{"required", "min:3"},
 		"username":        []string{"required", "alpha_num", "between:3,16"},
-		"password":        []string{"required", "between:8,32"},
+		"email":           []string{"email"},
+		"password":        []string{"required"},
 		"profileImageUrl": []string{"url"},
 	}
 
@@ -66,6 +69,13 @@ func createAdmin(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if e := validatePasswordPolicy("password", admin.Password, admin.Username, admin.Name); len(e) != 0 {
+		result.ValidationError = e
+
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
 	hash, err := hashPassword(admin.Password)
 	if err != nil {
 		result.ErrorMsg = err.Error()
@@ -74,6 +84,9 @@ func createAdmin(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 	admin.Password = hash
+	admin.Role = adminRoleAdmin
+	admin.TOTPEnabled = false
+	admin.Email = strings.ToLower(admin.Email)
 
 	err = mgm.Coll(admin).FindOne(
 		mgm.Ctx(),
@@ -90,6 +103,22 @@ func createAdmin(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if admin.Email != "" {
+		err = mgm.Coll(admin).FindOne(
+			mgm.Ctx(),
+			bson.M{
+				"email": admin.Email,
+			},
+		).Err()
+		if err == nil {
+			result.ErrorMsg = "Email already exist"
+			rw.WriteHeader(http.StatusConflict)
+			json.NewEncoder(rw).Encode(result)
+
+			return
+		}
+	}
+
 	err = mgm.Coll(admin).Create(admin)
 	if err != nil {
 		log.Println(err)
@@ -99,6 +128,8 @@ func createAdmin(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	recordAuditAs(r, admin.Username, "admin.create", auditTargetAdmin, admin.ID.Hex(), nil, admin)
+
 	adminMarshal, err := json.Marshal(admin)
 	if err != nil {
 		result.ErrorMsg = err.Error()
@@ -124,7 +155,7 @@ func adminLogin(rw http.ResponseWriter, r *http.Request) {
 
 	rules := govalidator.MapData{
 		"username": []string{"required", "alpha_num", "between:3,16"},
-		"password": []string{"required", "between:8,32"},
+		"password": []string{"required"},
 	}
 
 	opts := govalidator.Options{
@@ -142,74 +173,111 @@ func adminLogin(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := mgm.Coll(admin).FindOne(
+	throttled, err := isLoginThrottled(r, admin.Username)
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	if throttled {
+		result.ErrorMsg = loginThrottledMsg
+		rw.WriteHeader(http.StatusTooManyRequests)
+		json.NewEncoder(rw).Encode(result)
+
+		return
+	}
+
+	err = mgm.Coll(admin).FindOne(
 		mgm.Ctx(),
 		bson.M{
 			"username": admin.Username,
 		},
 	).Decode(&adminFromDB)
 	if err != nil {
-		result.ErrorMsg = "Username not exist"
-		rw.WriteHeader(http.StatusConflict)
+		checkPasswordHash(admin.Password, dummyPasswordHash)
+		recordLoginFailure(r, admin.Username)
+
+		result.ErrorMsg = loginFailedMsg
+		rw.WriteHeader(http.StatusUnauthorized)
 		json.NewEncoder(rw).Encode(result)
 
 		return
 	}
 
-	if !adminFromDB.IsActive {
-		result.ErrorMsg = "Username not active"
+	if !checkPasswordHash(admin.Password, adminFromDB.Password) {
+		recordLoginFailure(r, admin.Username)
+
+		result.ErrorMsg = loginFailedMsg
+		rw.WriteHeader(http.StatusUnauthorized)
 		json.NewEncoder(rw).Encode(result)
 
 		return
 	}
 
-	if !checkPasswordHash(admin.Password, adminFromDB.Password) {
-		result.ErrorMsg = "Invalid Password"
+	if !adminFromDB.IsActive {
+		result.ErrorMsg = loginFailedMsg
+		rw.WriteHeader(http.StatusUnauthorized)
 		json.NewEncoder(rw).Encode(result)
 
 		return
 	}
 
-	token, err := createJWTToken(adminFromDB.Username)
+	err = resetLoginFailures(adminFromDB.Username)
 	if err != nil {
-		result.ErrorMsg = err.Error()
-		json.NewEncoder(rw).Encode(result)
-		return
+		log.Println(err)
 	}
 
-	err = createAuth(adminFromDB.Username, token)
+	data, err := adminLoginData(adminFromDB, r)
 	if err != nil {
+		log.Println(err)
 		result.ErrorMsg = err.Error()
 		json.NewEncoder(rw).Encode(result)
 		return
 	}
 
-	data, err := json.Marshal(
-		map[string]interface{}{
-			"data": map[string]interface{}{
-				"id":                adminFromDB.ID,
-				"username":          adminFromDB.Username,
-				"name":              adminFromDB.Name,
-				"profile_image_url": adminFromDB.ProfileImageURL,
-			},
-			"accessToken":  token.AccessToken,
-			"refreshToken": token.RefreshToken,
-		},
-	)
+	result.Data, err = json.Marshal(data)
 	if err != nil {
 		result.ErrorMsg = err.Error()
 		json.NewEncoder(rw).Encode(result)
 		return
 	}
-
-	result.Data = data
-
 	result.Status = true
 
 	json.NewEncoder(rw).Encode(result)
 	return
 }
 
+//adminLoginData response data for an admin whose first factor passed, the
+//token pair is only issued by adminLoginVerifyTOTP when a second factor is
+//needed
+func adminLoginData(admin *Admin, r *http.Request) (map[string]interface{}, error) {
+	totpRequired, err := isTOTPRequired(admin)
+	if err != nil {
+		return nil, err
+	}
+
+	if admin.TOTPEnabled || totpRequired {
+		mfaToken, err := createMFAChallenge(admin.Username)
+		if err != nil {
+			return nil, err
+		}
+
+		return map[string]interface{}{
+			"mfaRequired":    true,
+			"enrollRequired": !admin.TOTPEnabled,
+			"mfaToken":       mfaToken,
+		}, nil
+	}
+
+	token, err := createSession(admin.Username, r)
+	if err != nil {
+		return nil, err
+	}
+
+	return loginData(admin, token), nil
+}
+
 func adminRefreshToken(rw http.ResponseWriter, r *http.Request) {
 	result := &HTTPResponse{}
 
@@ -236,12 +304,7 @@ func adminRefreshToken(rw http.ResponseWriter, r *http.Request) {
 	}
 
 	refreshToken := mapToken.RefreshToken
-	token, err := jwt.Parse(refreshToken, func(t *jwt.Token) (interface{}, error) {
-		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
-		}
-		return []byte(cfg.JWT.RefreshSecretKey), nil
-	})
+	token, err := jwtKeys.parse(refreshToken, tokenTypeRefresh)
 	if err != nil {
 		log.Println(err)
 		result.ErrorMsg = "Refresh token expired"
@@ -270,22 +333,37 @@ func adminRefreshToken(rw http.ResponseWriter, r *http.Request) {
 			json.NewEncoder(rw).Encode(result)
 			return
 		}
-		deleted, err := deleteAuth(refreshUUID)
-		if err != nil || deleted == 0 {
+		sessionID, _ := claims["session_id"].(string)
+		session, err := getSession(sessionID)
+		if err != nil || session == nil || session.Username != username {
 			log.Println(err)
 			result.ErrorMsg = "unauthorized"
 			json.NewEncoder(rw).Encode(result)
 			return
 		}
-
-		ts, err := createJWTToken(username)
+		// the session is the refresh token family, a token of the family
+		// that was already rotated out means it leaked, so the family dies
+		if session.RefreshUUID != refreshUUID {
+			revokeRefreshFamily(r, session, refreshUUID)
+			result.ErrorMsg = "unauthorized"
+			json.NewEncoder(rw).Encode(result)
+			return
+		}
+		deleted, err := deleteAuth(refreshUUID)
 		if err != nil {
 			log.Println(err)
-			result.ErrorMsg = err.Error()
+			result.ErrorMsg = "unauthorized"
 			json.NewEncoder(rw).Encode(result)
 			return
 		}
-		err = createAuth(username, ts)
+		if deleted == 0 {
+			revokeRefreshFamily(r, session, refreshUUID)
+			result.ErrorMsg = "unauthorized"
+			json.NewEncoder(rw).Encode(result)
+			return
+		}
+
+		ts, err := rotateSession(session)
 		if err != nil {
 			log.Println(err)
 			result.ErrorMsg = err.Error()
@@ -323,8 +401,8 @@ func adminLogout(rw http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(rw).Encode(result)
 		return
 	}
-	deleted, err := deleteAuth(au.AccessUUID)
-	if err != nil || deleted == 0 {
+	revoked, err := revokeSession(au.Username, au.SessionID)
+	if err != nil || !revoked {
 		log.Println(err)
 		result.ErrorMsg = "unauthorized"
 		json.NewEncoder(rw).Encode(result)
@@ -340,13 +418,15 @@ func adminChangePassword(rw http.ResponseWriter, r *http.Request) {
 	result := &HTTPResponse{}
 
 	mapPassword := &struct {
-		Password       string `json:"password"`
-		PasswordVerify string `json:"verify"`
+		CurrentPassword string `json:"currentPassword"`
+		Password        string `json:"password"`
+		PasswordVerify  string `json:"verify"`
 	}{}
 
 	rules := govalidator.MapData{
-		"password": []string{"required", "between:8,32"},
-		"verify":   []string{"required", "between:8,32"},
+		"currentPassword": []string{"required"},
+		"password":        []string{"required"},
+		"verify":          []string{"required"},
 	}
 
 	opts := govalidator.Options{
@@ -370,26 +450,27 @@ func adminChangePassword(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	meta, err := extractTokenMetadata(r)
-	if err != nil {
-		result.ErrorMsg = err.Error()
+	meta := accessFromContext(r)
+	admin := adminFromContext(r)
 
+	if !checkPasswordHash(mapPassword.CurrentPassword, admin.Password) {
+		result.ErrorMsg = "Invalid Password"
+
+		rw.WriteHeader(http.StatusForbidden)
 		json.NewEncoder(rw).Encode(result)
 		return
 	}
 
-	admin := &Admin{}
-
-	err = mgm.Coll(admin).FindOne(
-		mgm.Ctx(),
-		bson.M{
-			"username": meta.Username,
-		},
-	).Decode(&admin)
+	if e := validatePasswordPolicy("password", mapPassword.Password, admin.Username, admin.Name); len(e) != 0 {
+		result.ValidationError = e
 
-	if err != nil {
-		// result.ErrorMsg = "Username not exist"
-		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	if checkPasswordHash(mapPassword.Password, admin.Password) {
+		result.ValidationError = url.Values{
+			"password": []string{"The password field must differ from the current password"},
+		}
 
 		json.NewEncoder(rw).Encode(result)
 		return
@@ -402,6 +483,7 @@ func adminChangePassword(rw http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(rw).Encode(result)
 		return
 	}
+	before := *admin
 	admin.Password = hash
 	admin.UpdatedAt = time.Now()
 
@@ -415,78 +497,280 @@ func adminChangePassword(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	recordAudit(r, "admin.change_password", auditTargetAdmin, admin.ID.Hex(), before, admin)
+
+	err = revokeAllSessions(admin.Username, meta.SessionID)
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
 	result.Status = true
 
 	json.NewEncoder(rw).Encode(result)
 	return
 }
 
-func createCarousel(rw http.ResponseWriter, r *http.Request) {
-	result := &HTTPResponse{
-		Status: false,
-	}
+//updateAdminRole change the role of an admin, superadmins can not change
+//their own role so at least one always remains
+func updateAdminRole(rw http.ResponseWriter, r *http.Request) {
+	result := &HTTPResponse{}
+
+	mapRole := &struct {
+		Role string `json:"role"`
+	}{}
 
 	rules := govalidator.MapData{
-		"title":        []string{"required", "min:3"},
-		"description":  []string{},
-		"file:content": []string{"required", "ext:mp4", "mime:video/mp4"},
+		"role": []string{"required", "in:admin,superadmin,judge"},
 	}
 
 	opts := govalidator.Options{
 		Request: r,
+		Data:    mapRole,
 		Rules:   rules,
 	}
 
 	v := govalidator.New(opts)
-
-	if e := v.Validate(); len(e) != 0 {
+	if e := v.ValidateJSON(); len(e) != 0 {
 		result.ValidationError = e
+
 		json.NewEncoder(rw).Encode(result)
+		return
+	}
 
+	username := mux.Vars(r)["username"]
+	if username == adminFromContext(r).Username {
+		result.ErrorMsg = "You can not change your own role"
+
+		rw.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(rw).Encode(result)
 		return
 	}
 
-	r.ParseMultipartForm(0)
+	admin := &Admin{}
+	err := mgm.Coll(admin).First(bson.M{"username": username}, admin)
+	if err != nil {
+		result.ErrorMsg = "Data Not Found"
 
-	carousel := &Carousel{
-		Uploader: &Uploader{},
-		Content: &Content{
-			Title:       r.FormValue("title"),
-			Description: r.FormValue("description"),
-		},
+		rw.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	before := *admin
+	admin.Role = mapRole.Role
+
+	err = mgm.Coll(admin).Update(admin)
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	recordAudit(r, "admin.update_role", auditTargetAdmin, admin.ID.Hex(), before, admin)
+
+	result.Status = true
+
+	json.NewEncoder(rw).Encode(result)
+	return
+}
+
+//updateAdminActive activate or deactivate an admin, deactivating also ends
+//every session of the admin
+func updateAdminActive(rw http.ResponseWriter, r *http.Request) {
+	result := &HTTPResponse{}
+
+	mapActive := &struct {
+		IsActive *bool `json:"isActive"`
+	}{}
+
+	if err := json.NewDecoder(r.Body).Decode(mapActive); err != nil || mapActive.IsActive == nil {
+		result.ValidationError = url.Values{
+			"isActive": []string{"The isActive field is required"},
+		}
+
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	username := mux.Vars(r)["username"]
+	if username == adminFromContext(r).Username {
+		result.ErrorMsg = "You can not change your own activation"
+
+		rw.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	admin := &Admin{}
+	err := mgm.Coll(admin).First(bson.M{"username": username}, admin)
+	if err != nil {
+		result.ErrorMsg = "Data Not Found"
+
+		rw.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	before := *admin
+	admin.IsActive = *mapActive.IsActive
+
+	_, err = mgm.Coll(admin).UpdateOne(mgm.Ctx(), bson.M{"_id": admin.ID}, bson.M{
+		"$set": bson.M{"isActive": admin.IsActive, "updated_at": time.Now()},
+	})
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	if !admin.IsActive {
+		if err := revokeAllSessions(admin.Username, ""); err != nil {
+			log.Println(err)
+		}
+	}
+
+	recordAudit(r, "admin.update_active", auditTargetAdmin, admin.ID.Hex(), before, admin)
+
+	result.Status = true
+
+	json.NewEncoder(rw).Encode(result)
+	return
+}
+
+//updateAdminEmail set the email of an admin, where password reset links are
+//sent to
+func updateAdminEmail(rw http.ResponseWriter, r *http.Request) {
+	result := &HTTPResponse{}
+
+	mapEmail := &struct {
+		Email string `json:"email"`
+	}{}
+
+	rules := govalidator.MapData{
+		"email": []string{"required", "email"},
+	}
+
+	opts := govalidator.Options{
+		Request: r,
+		Data:    mapEmail,
+		Rules:   rules,
 	}
 
-	tokenString := extractTokenFromRequest(r)
-	token, _ := verifyJWTToken(tokenString)
-	claims := token.Claims.(jwt.MapClaims)
-	username := claims["username"].(string)
+	v := govalidator.New(opts)
+	if e := v.ValidateJSON(); len(e) != 0 {
+		result.ValidationError = e
+
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
 
-	adminData := &Admin{}
+	admin := &Admin{}
+	err := mgm.Coll(admin).First(bson.M{"username": mux.Vars(r)["username"]}, admin)
+	if err != nil {
+		result.ErrorMsg = "Data Not Found"
 
-	err := mgm.Coll(adminData).FindOne(
+		rw.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	email := strings.ToLower(mapEmail.Email)
+
+	err = mgm.Coll(admin).FindOne(
 		mgm.Ctx(),
 		bson.M{
-			"username": username,
+			"email": email,
+			"_id":   bson.M{"$ne": admin.ID},
 		},
-	).Decode(&adminData)
+	).Err()
+	if err == nil {
+		result.ErrorMsg = "Email already exist"
+		rw.WriteHeader(http.StatusConflict)
+		json.NewEncoder(rw).Encode(result)
+
+		return
+	}
+
+	before := *admin
+	admin.Email = email
+
+	_, err = mgm.Coll(admin).UpdateOne(mgm.Ctx(), bson.M{"_id": admin.ID}, bson.M{
+		"$set": bson.M{"email": admin.Email, "updated_at": time.Now()},
+	})
 	if err != nil {
+		log.Println(err)
 		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
 
-		rw.WriteHeader(http.StatusUnauthorized)
+	recordAudit(r, "admin.update_email", auditTargetAdmin, admin.ID.Hex(), before, admin)
+
+	result.Status = true
+
+	json.NewEncoder(rw).Encode(result)
+	return
+}
+
+func createCarousel(rw http.ResponseWriter, r *http.Request) {
+	result := &HTTPResponse{
+		Status: false,
+	}
+
+	rules := govalidator.MapData{
+		"contest":      []string{"required"},
+		"title":        []string{"required", "min:3"},
+		"description":  []string{},
+		"file:content": []string{"required", "ext:mp4", "mime:video/mp4"},
+	}
+
+	opts := govalidator.Options{
+		Request: r,
+		Rules:   rules,
+	}
+
+	v := govalidator.New(opts)
+
+	if e := v.Validate(); len(e) != 0 {
+		result.ValidationError = e
 		json.NewEncoder(rw).Encode(result)
 
 		return
 	}
 
-	if !adminData.IsActive {
-		result.ErrorMsg = "Username not active"
+	r.ParseMultipartForm(0)
 
-		rw.WriteHeader(http.StatusUnauthorized)
+	contest, e, err := contestFromRequest(r, true)
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	if len(e) != 0 {
+		result.ValidationError = e
 		json.NewEncoder(rw).Encode(result)
 
 		return
 	}
 
+	carousel := &Carousel{
+		ContestID: contest.ID,
+		Uploader:  &Uploader{},
+		Content: &Content{
+			Title:       r.FormValue("title"),
+			Description: r.FormValue("description"),
+		},
+	}
+
+	adminData := adminFromContext(r)
+
 	carousel.Uploader.Name = adminData.Name
 	carousel.Uploader.Username = adminData.Username
 	carousel.Uploader.ProfileImageURL = adminData.ProfileImageURL
@@ -541,6 +825,8 @@ func createCarousel(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	recordAudit(r, "carousel.create", auditTargetCarousel, carousel.ID.Hex(), nil, carousel)
+
 	carouselMarshal, err := json.Marshal(carousel)
 	if err != nil {
 		log.Println(err)
@@ -572,12 +858,17 @@ func getAllCarousel(rw http.ResponseWriter, r *http.Request) {
 	}
 	sortN, _ := strconv.Atoi(sort)
 
+	filter, ok := contestFilter(rw, r, result)
+	if !ok {
+		return
+	}
+
 	carousels := []Carousel{}
 
 	findOptions := &options.FindOptions{}
 	findOptions.SetSort(bson.M{"updated_at": sortN})
 
-	err := mgm.Coll(&Carousel{}).SimpleFind(&carousels, bson.M{}, findOptions)
+	err := mgm.Coll(&Carousel{}).SimpleFind(&carousels, filter, findOptions)
 	if err != nil {
 		log.Println(err)
 		result.ErrorMsg = err.Error()
@@ -605,6 +896,7 @@ func createGallery(rw http.ResponseWriter, r *http.Request) {
 	result := &HTTPResponse{}
 
 	rules := govalidator.MapData{
+		"contest":      []string{"required"},
 		"title":        []string{"required", "min:3"},
 		"description":  []string{},
 		"file:content": []string{"required", "ext:jpg,jpeg,png", "mime:image/jpg,image/jpeg,image/png"},
@@ -626,45 +918,31 @@ func createGallery(rw http.ResponseWriter, r *http.Request) {
 
 	r.ParseMultipartForm(0)
 
-	gallery := &Gallery{
-		Uploader: &Uploader{},
-		Content: &ContentGallery{
-			Title:       r.FormValue("title"),
-			Description: r.FormValue("description"),
-		},
-	}
-
-	tokenString := extractTokenFromRequest(r)
-	token, _ := verifyJWTToken(tokenString)
-	claims := token.Claims.(jwt.MapClaims)
-	username := claims["username"].(string)
-
-	adminData := &Admin{}
-
-	err := mgm.Coll(adminData).FindOne(
-		mgm.Ctx(),
-		bson.M{
-			"username": username,
-		},
-	).Decode(&adminData)
+	contest, e, err := contestFromRequest(r, true)
 	if err != nil {
+		log.Println(err)
 		result.ErrorMsg = err.Error()
-
-		rw.WriteHeader(http.StatusUnauthorized)
 		json.NewEncoder(rw).Encode(result)
-
 		return
 	}
-
-	if !adminData.IsActive {
-		result.ErrorMsg = "Username not active"
-
-		rw.WriteHeader(http.StatusUnauthorized)
+	if len(e) != 0 {
+		result.ValidationError = e
 		json.NewEncoder(rw).Encode(result)
 
 		return
 	}
 
+	gallery := &Gallery{
+		ContestID: contest.ID,
+		Uploader:  &Uploader{},
+		Content: &ContentGallery{
+			Title:       r.FormValue("title"),
+			Description: r.FormValue("description"),
+		},
+	}
+
+	adminData := adminFromContext(r)
+
 	gallery.Uploader.Name = adminData.Name
 	gallery.Uploader.Username = adminData.Username
 	gallery.Uploader.ProfileImageURL = adminData.ProfileImageURL
@@ -723,6 +1001,8 @@ func createGallery(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	recordAudit(r, "gallery.create", auditTargetGallery, gallery.ID.Hex(), nil, gallery)
+
 	galleryMarshal, err := json.Marshal(gallery)
 	if err != nil {
 		log.Println(err)
@@ -778,6 +1058,32 @@ func getAllContestant(rw http.ResponseWriter, r *http.Request) {
 
 	sortN, _ := strconv.Atoi(sort)
 
+	contest, e, err := contestFromRequest(r, false)
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	if len(e) != 0 {
+		result.ValidationError = e
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	filter := bson.M{"contestId": contest.ID}
+
+	state := r.URL.Query().Get("state")
+	if state != "" {
+		if !isContestantState(state) {
+			result.ValidationError = url.Values{
+				"state": []string{fmt.Sprintf("The state field must be one of %s", strings.Join(contestantStates, ", "))},
+			}
+			json.NewEncoder(rw).Encode(result)
+			return
+		}
+		filter["status"] = contestantStateFilter(state)
+	}
+
 	contestant := []Contestant{}
 
 	skip := page*limit - limit
@@ -789,14 +1095,14 @@ func getAllContestant(rw http.ResponseWriter, r *http.Request) {
 		findOptions.SetSkip(int64(skip))
 	}
 
-	err := mgm.Coll(&Contestant{}).SimpleFind(&contestant, bson.M{}, findOptions)
+	err = mgm.Coll(&Contestant{}).SimpleFind(&contestant, filter, findOptions)
 	if err != nil {
 		log.Println(err)
 		result.ErrorMsg = err.Error()
 		json.NewEncoder(rw).Encode(result)
 		return
 	}
-	total, err := mgm.Coll(&Contestant{}).CountDocuments(mgm.Ctx(), bson.M{})
+	total, err := mgm.Coll(&Contestant{}).CountDocuments(mgm.Ctx(), filter)
 	if err != nil {
 		log.Println(err)
 		result.ErrorMsg = err.Error()
@@ -804,8 +1110,21 @@ func getAllContestant(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// reading contestant personal data is audited like a change
+	recordAudit(r, "contestant.list", auditTargetContestant, "", nil, map[string]interface{}{
+		"contest":  contest.Slug,
+		"state":    state,
+		"sort_by":  sortBy,
+		"sort":     sort,
+		"limit":    limit,
+		"page":     page,
+		"returned": len(contestant),
+	})
+
 	resultMarshal, err := json.Marshal(map[string]interface{}{
 		"data":    contestant,
+		"contest": contest,
+		"state":   state,
 		"sort_by": sortBy,
 		"sort":    sort,
 		"limit":   limit,
@@ -861,6 +1180,11 @@ func getGalleries(rw http.ResponseWriter, r *http.Request) {
 
 	sortN, _ := strconv.Atoi(sort)
 
+	filter, ok := contestFilter(rw, r, result)
+	if !ok {
+		return
+	}
+
 	galleries := []Gallery{}
 
 	skip := page*limit - limit
@@ -870,7 +1194,7 @@ func getGalleries(rw http.ResponseWriter, r *http.Request) {
 	findOptions.SetSort(bson.M{"updated_at": sortN})
 	findOptions.SetSkip(int64(skip))
 
-	err := mgm.Coll(&Gallery{}).SimpleFind(&galleries, bson.M{}, findOptions)
+	err := mgm.Coll(&Gallery{}).SimpleFind(&galleries, filter, findOptions)
 	if err != nil {
 		log.Println(err)
 		result.ErrorMsg = err.Error()
@@ -926,7 +1250,12 @@ func uploadVideo(rw http.ResponseWriter, r *http.Request) {
 		Status: false,
 	}
 
+	// the deadline is checked against the time the upload started, not the
+	// time the video finished transferring
+	receivedAt := time.Now()
+
 	rules := govalidator.MapData{
+		"contest":    []string{"required"},
 		"name":       []string{"required", "min:3"},
 		"email":      []string{"required", "email"},
 		"school":     []string{"required", "min:8"},
@@ -951,16 +1280,47 @@ func uploadVideo(rw http.ResponseWriter, r *http.Request) {
 
 	r.ParseMultipartForm(0)
 
+	contest, e, err := contestFromRequest(r, true)
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	if len(e) != 0 {
+		result.ValidationError = e
+		json.NewEncoder(rw).Encode(result)
+
+		return
+	}
+
+	if !contest.Window.AcceptsUploads(receivedAt) {
+		result.ErrorMsg = contest.Window.windowError(receivedAt)
+
+		rw.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	// the deadline is saved with the submission itself, a contestant without
+	// one counts as verified
+	verificationExpiresAt := receivedAt.Add(cfg.ContestantVerification.ExpireAfter)
+
 	contestant := &Contestant{
-		Name:   r.FormValue("name"),
-		Email:  r.FormValue("email"),
-		School: r.FormValue("school"),
-		Title:  r.FormValue("title"),
-		Phone:  r.FormValue("phone"),
-		Video:  &ContestantVideo{},
+		ContestID: contest.ID,
+		Name:      r.FormValue("name"),
+		Email:     r.FormValue("email"),
+		School:    r.FormValue("school"),
+		Title:     r.FormValue("title"),
+		Phone:     r.FormValue("phone"),
+		Video:     &ContestantVideo{},
+
+		Status:                contestantSubmitted,
+		StatusChangedAt:       &receivedAt,
+		VerificationExpiresAt: &verificationExpiresAt,
 	}
 
-	err := mgm.Coll(contestant).Create(contestant)
+	err = mgm.Coll(contestant).Create(contestant)
 	if err != nil {
 		log.Println(err)
 		result.ErrorMsg = err.Error()
@@ -1003,6 +1363,11 @@ func uploadVideo(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// the submission is kept, it only counts once the email is verified
+	if err := sendEmailVerification(contestant); err != nil {
+		log.Println(err)
+	}
+
 	contestantMarshal, err := json.Marshal(contestant)
 	if err != nil {
 		result.ErrorMsg = err.Error()
@@ -1026,7 +1391,7 @@ func getVideo(rw http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 
-	_, err := primitive.ObjectIDFromHex(id)
+	objectID, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
 		result.ErrorMsg = "Data Not Found"
 
@@ -1037,7 +1402,11 @@ func getVideo(rw http.ResponseWriter, r *http.Request) {
 
 	contestant := &Contestant{}
 
-	err = mgm.Coll(contestant).FindByID(id, contestant)
+	// only approved or later entries are public
+	err = mgm.Coll(contestant).First(bson.M{
+		"_id":    objectID,
+		"status": publicContestantFilter(),
+	}, contestant)
 	if err != nil {
 		result.ErrorMsg = "Data Not Found"
 
@@ -1046,7 +1415,7 @@ func getVideo(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	contestantMarshal, err := json.Marshal(contestant)
+	contestantMarshal, err := json.Marshal(newPublicContestant(contestant))
 	if err != nil {
 		log.Println(err)
 		result.ErrorMsg = err.Error()
@@ -1089,6 +1458,8 @@ func getAsset(rw http.ResponseWriter, r *http.Request) {
 func Router() *mux.Router {
 	router := mux.NewRouter().StrictSlash(true)
 
+	router.Handle("/.well-known/jwks.json", CORSMiddleware(http.HandlerFunc(getJWKS))).Methods("GET", "OPTIONS")
+
 	apiV1 := router.PathPrefix("/api/v1").Subrouter()
 	admin := apiV1.PathPrefix("/admin").Subrouter()
 	contest := apiV1.PathPrefix("/contest").Subrouter()
@@ -1101,25 +1472,104 @@ func Router() *mux.Router {
 	admin.Use(JSONResponseMiddleware)
 	admin.HandleFunc("/create", createAdmin).Methods("POST", "OPTIONS")
 	admin.HandleFunc("/login", adminLogin).Methods("POST", "OPTIONS")
+	admin.HandleFunc("/login/2fa", adminLoginVerifyTOTP).Methods("POST", "OPTIONS")
+	admin.HandleFunc("/login/2fa/enroll", adminLoginEnrollTOTP).Methods("POST", "OPTIONS")
 	admin.HandleFunc("/logout", adminLogout).Methods("GET", "OPTIONS")
 	admin.HandleFunc("/refresh-token", adminRefreshToken).Methods("POST", "OPTIONS")
+	admin.HandleFunc("/forgot-password", adminForgotPassword).Methods("POST", "OPTIONS")
+	admin.HandleFunc("/reset-password", adminResetPassword).Methods("POST", "OPTIONS")
+	admin.HandleFunc("/oidc/login", adminOIDCLogin).Methods("GET", "OPTIONS")
+	admin.HandleFunc("/oidc/callback", adminOIDCCallback).Methods("POST", "OPTIONS")
 
 	adminAuth := admin.PathPrefix("/").Subrouter()
 	adminAuth.Use(VerifyAuthTokenMiddleware)
 
 	adminAuthProfile := adminAuth.PathPrefix("/profile").Subrouter()
 	adminAuthProfile.HandleFunc("/change-password", adminChangePassword).Methods("PUT", "OPTIONS")
+	adminAuthProfile.HandleFunc("/sessions", getAdminSessions).Methods("GET", "OPTIONS")
+	adminAuthProfile.HandleFunc("/sessions", revokeAdminSessions).Methods("DELETE", "OPTIONS")
+	adminAuthProfile.HandleFunc("/sessions/{id}", revokeAdminSession).Methods("DELETE", "OPTIONS")
+	adminAuthProfile.HandleFunc("/2fa", disableTOTP).Methods("DELETE", "OPTIONS")
+	adminAuthProfile.HandleFunc("/2fa/enroll", enrollTOTP).Methods("POST", "OPTIONS")
+	adminAuthProfile.HandleFunc("/2fa/verify", verifyTOTPEnrollment).Methods("POST", "OPTIONS")
+	adminAuthProfile.HandleFunc("/2fa/recovery-codes", regenerateRecoveryCodes).Methods("POST", "OPTIONS")
+	adminAuthProfile.HandleFunc("/affiliations", updateAffiliations).Methods("PUT", "OPTIONS")
 
 	adminAuthManage := adminAuth.PathPrefix("/manage").Subrouter()
+	adminAuthManage.Use(StaffMiddleware)
 	adminAuthManage.HandleFunc("/carousel", createCarousel).Methods("POST", "OPTIONS")
 	adminAuthManage.HandleFunc("/gallery", createGallery).Methods("POST", "OPTIONS")
 
+	adminAuthManage.HandleFunc("/api-keys", getAPIKeys).Methods("GET", "OPTIONS")
+	adminAuthManage.HandleFunc("/api-keys", createAPIKey).Methods("POST", "OPTIONS")
+	adminAuthManage.HandleFunc("/api-keys/{id}", revokeAPIKey).Methods("DELETE", "OPTIONS")
+
+	adminAuthManageAdmins := adminAuthManage.PathPrefix("/admins").Subrouter()
+	adminAuthManageAdmins.Use(SuperadminMiddleware)
+	adminAuthManageAdmins.HandleFunc("/{username}/sessions", getAdminSessions).Methods("GET", "OPTIONS")
+	adminAuthManageAdmins.HandleFunc("/{username}/sessions", revokeAdminSessions).Methods("DELETE", "OPTIONS")
+	adminAuthManageAdmins.HandleFunc("/{username}/sessions/{id}", revokeAdminSession).Methods("DELETE", "OPTIONS")
+	adminAuthManageAdmins.HandleFunc("/{username}/unlock", unlockAdmin).Methods("POST", "OPTIONS")
+	adminAuthManageAdmins.HandleFunc("/{username}/role", updateAdminRole).Methods("PUT", "OPTIONS")
+	adminAuthManageAdmins.HandleFunc("/{username}/active", updateAdminActive).Methods("PUT", "OPTIONS")
+	adminAuthManageAdmins.HandleFunc("/{username}/email", updateAdminEmail).Methods("PUT", "OPTIONS")
+
+	adminAuthManageSecurity := adminAuthManage.PathPrefix("/security").Subrouter()
+	adminAuthManageSecurity.Use(SuperadminMiddleware)
+	adminAuthManageSecurity.HandleFunc("/2fa-policy", getTOTPPolicy).Methods("GET", "OPTIONS")
+	adminAuthManageSecurity.HandleFunc("/2fa-policy", updateTOTPPolicy).Methods("PUT", "OPTIONS")
+	adminAuthManageSecurity.HandleFunc("/audit-logs", getAuditLogs).Methods("GET", "OPTIONS")
+
+	adminAuthManage.HandleFunc("/contests", getAllContest).Methods("GET", "OPTIONS")
+	adminAuthManage.HandleFunc("/contests", createContest).Methods("POST", "OPTIONS")
+	adminAuthManage.HandleFunc("/contests/{id}/archive", archiveContest).Methods("POST", "OPTIONS")
+	adminAuthManage.HandleFunc("/contests/{id}/window", updateContestWindow).Methods("PUT", "OPTIONS")
+	adminAuthManage.HandleFunc("/contests/{id}/rubric", getContestRubric).Methods("GET", "OPTIONS")
+	adminAuthManage.HandleFunc("/contests/{id}/rubric", updateContestRubric).Methods("PUT", "OPTIONS")
+	adminAuthManage.HandleFunc("/contests/{id}/scores", getContestScores).Methods("GET", "OPTIONS")
+	adminAuthManage.HandleFunc("/contests/{id}/scores/compare", compareScoreModes).Methods("GET", "OPTIONS")
+	adminAuthManage.HandleFunc("/contests/{id}/score-mode", updateScoreMode).Methods("PUT", "OPTIONS")
+	adminAuthManage.HandleFunc("/contests/{id}/assignments", getContestAssignments).Methods("GET", "OPTIONS")
+	adminAuthManage.HandleFunc("/contests/{id}/assignments", runAssignments).Methods("POST", "OPTIONS")
+	adminAuthManage.HandleFunc("/assignments/{id}", reassignAssignment).Methods("PUT", "OPTIONS")
+	adminAuthManage.HandleFunc("/contests/{id}/conflict-exceptions", getConflictExceptions).Methods("GET", "OPTIONS")
+	adminAuthManage.HandleFunc("/conflict-exceptions", createConflictException).Methods("POST", "OPTIONS")
+	adminAuthManage.HandleFunc("/conflict-exceptions/{id}", revokeConflictException).Methods("DELETE", "OPTIONS")
+	adminAuthManage.HandleFunc("/contests/{id}/votes", getVoteTally).Methods("GET", "OPTIONS")
+	adminAuthManage.HandleFunc("/contests/{id}/votes/review", getVoteReviewQueue).Methods("GET", "OPTIONS")
+	adminAuthManage.HandleFunc("/votes/{id}/review", reviewVote).Methods("PUT", "OPTIONS")
+	adminAuthManage.HandleFunc("/contests/{id}/leaderboard", getContestLeaderboard).Methods("GET", "OPTIONS")
+	adminAuthManage.HandleFunc("/contests/{id}/leaderboard", updateLeaderboardSetting).Methods("PUT", "OPTIONS")
+
 	adminAuthContestant := adminAuth.PathPrefix("/contestant").Subrouter()
-	adminAuthContestant.HandleFunc("/list", getAllContestant).Methods("GET", "OPTIONS")
+	adminAuthContestant.Use(StaffMiddleware)
+	adminAuthContestant.Handle("/list", requireScope(scopeContestantsRead, getAllContestant)).Methods("GET", "OPTIONS")
+	adminAuthContestant.HandleFunc("/{id}/annotations", getContestantAnnotations).Methods("GET", "OPTIONS")
+	adminAuthContestant.HandleFunc("/{id}/state", transitionContestant).Methods("PUT", "OPTIONS")
+
+	adminAuthJudging := adminAuth.PathPrefix("/judging").Subrouter()
+	adminAuthJudging.Use(JudgeMiddleware)
+	adminAuthJudging.HandleFunc("/contests/{id}/rubric", getContestRubric).Methods("GET", "OPTIONS")
+	adminAuthJudging.HandleFunc("/queue", getJudgeQueue).Methods("GET", "OPTIONS")
+	adminAuthJudging.HandleFunc("/contestants/{id}/score", submitScore).Methods("PUT", "OPTIONS")
+	adminAuthJudging.HandleFunc("/contestants/{id}/annotations", getJudgeAnnotations).Methods("GET", "OPTIONS")
+	adminAuthJudging.HandleFunc("/contestants/{id}/annotations", createAnnotation).Methods("POST", "OPTIONS")
+	adminAuthJudging.HandleFunc("/annotations/{id}", updateAnnotation).Methods("PUT", "OPTIONS")
+	adminAuthJudging.HandleFunc("/annotations/{id}", deleteAnnotation).Methods("DELETE", "OPTIONS")
 
 	contest.Use(JSONResponseMiddleware)
 	contest.HandleFunc("/uploadVideo", uploadVideo).Methods("POST", "OPTIONS")
+	contest.HandleFunc("/verify-email", verifyContestantEmail).Methods("POST", "OPTIONS")
+	contest.HandleFunc("/verify-email/resend", resendContestantEmail).Methods("POST", "OPTIONS")
+	contest.HandleFunc("/verify-phone", verifyPhoneOTP).Methods("POST", "OPTIONS")
+	contest.HandleFunc("/verify-phone/send", sendPhoneOTP).Methods("POST", "OPTIONS")
 	contest.HandleFunc("/video/{id}", getVideo).Methods("GET", "OPTIONS")
+	contest.HandleFunc("", getContests).Methods("GET", "OPTIONS")
+	contest.HandleFunc("/{slug}", getContest).Methods("GET", "OPTIONS")
+	contest.HandleFunc("/{slug}/window", getContestWindow).Methods("GET", "OPTIONS")
+	contest.HandleFunc("/{slug}/votes", requestVote).Methods("POST", "OPTIONS")
+	contest.HandleFunc("/{slug}/votes/verify", verifyVote).Methods("POST", "OPTIONS")
+	contest.HandleFunc("/{slug}/leaderboard", getLeaderboard).Methods("GET", "OPTIONS")
 
 	carousel.Use(JSONResponseMiddleware)
 	carousel.HandleFunc("", getAllCarousel).Methods("GET", "OPTIONS")
@@ -0,0 +1,434 @@
+// Copyright (C) 2021 Administrator
+//
+// This file is part of backend.
+//
+// backend is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// backend is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with backend.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/twinj/uuid"
+)
+
+//adminSession login session of an admin stored in redis
+type adminSession struct {
+	ID          string    `json:"id"`
+	Username    string    `json:"username"`
+	AccessUUID  string    `json:"-"`
+	RefreshUUID string    `json:"-"`
+	UserAgent   string    `json:"userAgent"`
+	IP          string    `json:"ip"`
+	CreatedAt   time.Time `json:"createdAt"`
+	LastUsedAt  time.Time `json:"lastUsedAt"`
+	Current     bool      `json:"current"`
+}
+
+func sessionKey(sessionID string) string {
+	return fmt.Sprintf("session:%s", sessionID)
+}
+
+func adminSessionsKey(username string) string {
+	return fmt.Sprintf("admin-sessions:%s", username)
+}
+
+//trustedProxies reverse proxies whose forwarding headers are believed
+var trustedProxies []*net.IPNet
+
+//parseTrustedProxies parse a list of ip addresses and cidr ranges
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy '%s'", proxy)
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy '%s': %v", proxy, err)
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+func isTrustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+//getRemoteIP get the address of the peer connected to the server
+func getRemoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+//getClientIP get the client ip address, forwarding headers are only honored
+//when the request comes from a trusted proxy
+func getClientIP(r *http.Request) string {
+	remoteIP := getRemoteIP(r)
+	if !isTrustedProxy(remoteIP) {
+		return remoteIP
+	}
+
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		//walk from the nearest hop, the first address not added by one of
+		//our proxies is the client
+		hops := strings.Split(forwarded, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if net.ParseIP(hop) == nil {
+				break
+			}
+			if i == 0 || !isTrustedProxy(hop) {
+				return hop
+			}
+		}
+	}
+	if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(realIP) != nil {
+		return realIP
+	}
+
+	return remoteIP
+}
+
+//createSession start a new session for username and issue its first token pair
+func createSession(username string, r *http.Request) (*tokenDetails, error) {
+	sessionID := uuid.NewV4().String()
+	now := time.Now()
+
+	td, err := createJWTToken(username, sessionID, now)
+	if err != nil {
+		return nil, err
+	}
+
+	err = redisClient.HSet(
+		sessionKey(sessionID),
+		"username", username,
+		"user_agent", r.UserAgent(),
+		"ip", getClientIP(r),
+		"created_at", now.Unix(),
+		"last_used_at", now.Unix(),
+	).Err()
+	if err != nil {
+		return nil, err
+	}
+
+	err = redisClient.SAdd(adminSessionsKey(username), sessionID).Err()
+	if err != nil {
+		return nil, err
+	}
+
+	err = createAuth(username, td)
+	if err != nil {
+		return nil, err
+	}
+
+	return td, nil
+}
+
+//rotateSession issue a new token pair for an existing session and
+//revoke the previous access token
+func rotateSession(session *adminSession) (*tokenDetails, error) {
+	td, err := createJWTToken(session.Username, session.ID, session.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	err = redisClient.Del(session.AccessUUID).Err()
+	if err != nil {
+		return nil, err
+	}
+
+	err = redisClient.HSet(
+		sessionKey(session.ID),
+		"last_used_at", time.Now().Unix(),
+	).Err()
+	if err != nil {
+		return nil, err
+	}
+
+	err = createAuth(session.Username, td)
+	if err != nil {
+		return nil, err
+	}
+
+	return td, nil
+}
+
+//getSession get session by id, returns nil when the session does not exist
+func getSession(sessionID string) (*adminSession, error) {
+	fields, err := redisClient.HGetAll(sessionKey(sessionID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 || fields["username"] == "" {
+		return nil, nil
+	}
+
+	createdAt, _ := strconv.ParseInt(fields["created_at"], 10, 64)
+	lastUsedAt, _ := strconv.ParseInt(fields["last_used_at"], 10, 64)
+
+	return &adminSession{
+		ID:          sessionID,
+		Username:    fields["username"],
+		AccessUUID:  fields["access_uuid"],
+		RefreshUUID: fields["refresh_uuid"],
+		UserAgent:   fields["user_agent"],
+		IP:          fields["ip"],
+		CreatedAt:   time.Unix(createdAt, 0),
+		LastUsedAt:  time.Unix(lastUsedAt, 0),
+	}, nil
+}
+
+//touchSession update last use time of a session
+func touchSession(sessionID string) error {
+	exists, err := redisClient.Exists(sessionKey(sessionID)).Result()
+	if err != nil || exists == 0 {
+		return err
+	}
+
+	return redisClient.HSet(sessionKey(sessionID), "last_used_at", time.Now().Unix()).Err()
+}
+
+//listSessions list active sessions of username, pruning the expired ones
+func listSessions(username string) ([]*adminSession, error) {
+	sessionIDs, err := redisClient.SMembers(adminSessionsKey(username)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := []*adminSession{}
+	for _, sessionID := range sessionIDs {
+		session, err := getSession(sessionID)
+		if err != nil {
+			return nil, err
+		}
+		if session == nil {
+			redisClient.SRem(adminSessionsKey(username), sessionID)
+			continue
+		}
+		sessions = append(sessions, session)
+	}
+
+	return sessions, nil
+}
+
+//revokeSession revoke a session of username and every token issued for it,
+//returns false when the session does not exist
+func revokeSession(username string, sessionID string) (bool, error) {
+	session, err := getSession(sessionID)
+	if err != nil {
+		return false, err
+	}
+	if session == nil || session.Username != username {
+		return false, nil
+	}
+
+	keys := []string{sessionKey(sessionID)}
+	if session.AccessUUID != "" {
+		keys = append(keys, session.AccessUUID)
+	}
+	if session.RefreshUUID != "" {
+		keys = append(keys, session.RefreshUUID)
+	}
+
+	err = redisClient.Del(keys...).Err()
+	if err != nil {
+		return false, err
+	}
+	err = redisClient.SRem(adminSessionsKey(username), sessionID).Err()
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+//revokeAllSessions revoke every session of username except keepSessionID
+func revokeAllSessions(username string, keepSessionID string) error {
+	sessionIDs, err := redisClient.SMembers(adminSessionsKey(username)).Result()
+	if err != nil {
+		return err
+	}
+
+	for _, sessionID := range sessionIDs {
+		if sessionID == keepSessionID {
+			continue
+		}
+		if _, err := revokeSession(username, sessionID); err != nil {
+			return err
+		}
+		redisClient.SRem(adminSessionsKey(username), sessionID)
+	}
+
+	return nil
+}
+
+//logSecurityEvent write a security relevant event to the server log
+func logSecurityEvent(r *http.Request, event string, format string, v ...interface{}) {
+	log.Printf(
+		"[SECURITY] event=%s ip=%s user_agent=%q %s",
+		event,
+		getClientIP(r),
+		r.UserAgent(),
+		fmt.Sprintf(format, v...),
+	)
+}
+
+//revokeRefreshFamily revoke a session after one of its rotated out refresh
+//tokens was presented again
+func revokeRefreshFamily(r *http.Request, session *adminSession, refreshUUID string) {
+	logSecurityEvent(
+		r,
+		"refresh_token_reuse",
+		"username=%s session_id=%s refresh_uuid=%s",
+		session.Username,
+		session.ID,
+		refreshUUID,
+	)
+
+	if _, err := revokeSession(session.Username, session.ID); err != nil {
+		log.Println(err)
+	}
+}
+
+//sessionTargetUsername username whose sessions are managed, superadmin
+//routes carry it in the path, profile routes use the logged in admin
+func sessionTargetUsername(r *http.Request) (string, *accessDetails) {
+	meta := accessFromContext(r)
+
+	if username, ok := mux.Vars(r)["username"]; ok {
+		return username, meta
+	}
+
+	return meta.Username, meta
+}
+
+func getAdminSessions(rw http.ResponseWriter, r *http.Request) {
+	result := &HTTPResponse{}
+
+	username, meta := sessionTargetUsername(r)
+
+	sessions, err := listSessions(username)
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	for _, session := range sessions {
+		session.Current = session.ID == meta.SessionID
+	}
+
+	sessionsMarshal, err := json.Marshal(sessions)
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	result.Data = sessionsMarshal
+	result.Status = true
+
+	json.NewEncoder(rw).Encode(result)
+	return
+}
+
+func revokeAdminSession(rw http.ResponseWriter, r *http.Request) {
+	result := &HTTPResponse{}
+
+	username, _ := sessionTargetUsername(r)
+
+	revoked, err := revokeSession(username, mux.Vars(r)["id"])
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	if !revoked {
+		result.ErrorMsg = "Data Not Found"
+
+		rw.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	recordAudit(r, "session.revoke", auditTargetSession, mux.Vars(r)["id"], nil, map[string]interface{}{
+		"username": username,
+	})
+
+	result.Status = true
+
+	json.NewEncoder(rw).Encode(result)
+	return
+}
+
+//revokeAdminSessions revoke all sessions, the session making the request is
+//kept so an admin can sign out every other device
+func revokeAdminSessions(rw http.ResponseWriter, r *http.Request) {
+	result := &HTTPResponse{}
+
+	username, meta := sessionTargetUsername(r)
+
+	err := revokeAllSessions(username, meta.SessionID)
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	recordAudit(r, "session.revoke_all", auditTargetSession, "", nil, map[string]interface{}{
+		"username": username,
+	})
+
+	result.Status = true
+
+	json.NewEncoder(rw).Encode(result)
+	return
+}
@@ -31,6 +31,7 @@ type HTTPResponse struct {
 }
 
 type tokenDetails struct {
+	SessionID    string
 	AccessToken  string
 	RefreshToken string
 	AccessUUID   string
@@ -42,4 +43,5 @@ type tokenDetails struct {
 type accessDetails struct {
 	AccessUUID string
 	Username   string
+	SessionID  string
 }
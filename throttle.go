@@ -0,0 +1,147 @@
+// Copyright (C) 2021 Administrator
+//
+// This file is part of backend.
+//
+// backend is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// backend is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with backend.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/gorilla/mux"
+)
+
+const (
+	loginFailedMsg    = "Invalid username or password"
+	loginThrottledMsg = "Too many login attempts, try again later"
+)
+
+//dummyPasswordHash compared against when the username does not exist, so
+//the response time does not tell whether it exists
+var dummyPasswordHash, _ = hashPassword("dummy-password-for-timing")
+
+func loginFailIPKey(ip string) string {
+	return fmt.Sprintf("login-fail:ip:%s", ip)
+}
+
+func loginFailUsernameKey(username string) string {
+	return fmt.Sprintf("login-fail:user:%s", strings.ToLower(username))
+}
+
+func loginLockKey(username string) string {
+	return fmt.Sprintf("login-lock:%s", strings.ToLower(username))
+}
+
+//isLoginThrottled check whether the client ip exceeded its attempts or the
+//username is locked out
+func isLoginThrottled(r *http.Request, username string) (bool, error) {
+	ipAttempts, err := redisClient.Get(loginFailIPKey(getClientIP(r))).Int()
+	if err != nil && err != redis.Nil {
+		return false, err
+	}
+	if ipAttempts >= cfg.Login.MaxAttemptsPerIP {
+		return true, nil
+	}
+
+	locked, err := redisClient.Exists(loginLockKey(username)).Result()
+	if err != nil {
+		return false, err
+	}
+
+	return locked > 0, nil
+}
+
+//incrementWindow increment a counter that resets after the attempt window
+func incrementWindow(key string) (int64, error) {
+	return incrementWindowFor(key, cfg.Login.AttemptWindow)
+}
+
+//incrementWindowFor increment a counter that resets window after its first
+//increment
+func incrementWindowFor(key string, window time.Duration) (int64, error) {
+	count, err := redisClient.Incr(key).Result()
+	if err != nil {
+		return 0, err
+	}
+	if count == 1 {
+		err = redisClient.Expire(key, window).Err()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return count, nil
+}
+
+//recordLoginFailure count a failed login for the client ip and username,
+//locking the username out once it reaches the limit
+func recordLoginFailure(r *http.Request, username string) {
+	if _, err := incrementWindow(loginFailIPKey(getClientIP(r))); err != nil {
+		log.Println(err)
+	}
+
+	count, err := incrementWindow(loginFailUsernameKey(username))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if count < int64(cfg.Login.MaxAttemptsPerUsername) {
+		return
+	}
+
+	err = redisClient.Set(loginLockKey(username), count, cfg.Login.LockoutDuration).Err()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	err = redisClient.Del(loginFailUsernameKey(username)).Err()
+	if err != nil {
+		log.Println(err)
+	}
+
+	logSecurityEvent(r, "login_lockout", "username=%s attempts=%d", username, count)
+}
+
+//resetLoginFailures forget failed logins of username after it logs in
+func resetLoginFailures(username string) error {
+	return redisClient.Del(loginFailUsernameKey(username)).Err()
+}
+
+func unlockAdmin(rw http.ResponseWriter, r *http.Request) {
+	result := &HTTPResponse{}
+
+	username := mux.Vars(r)["username"]
+
+	err := redisClient.Del(loginLockKey(username), loginFailUsernameKey(username)).Err()
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	recordAudit(r, "admin.unlock", auditTargetAdmin, username, nil, nil)
+
+	result.Status = true
+
+	json.NewEncoder(rw).Encode(result)
+	return
+}
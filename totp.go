@@ -0,0 +1,882 @@
+// Copyright (C) 2021 Administrator
+//
+// This file is part of backend.
+//
+// backend is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// backend is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with backend.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/kamva/mgm/v3"
+	"github.com/thedevsaddam/govalidator"
+	"github.com/twinj/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	totpPeriod            = 30
+	totpDigits            = 6
+	totpRecoveryCodeCount = 10
+	mfaChallengeTTL       = 5 * time.Minute
+	mfaChallengeAttempts  = 5
+	totpEnrollTTL         = 10 * time.Minute
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+//generateTOTPSecret generate a random base32 TOTP secret
+func generateTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+//totpCode RFC 6238 code of secret for the given time step
+func totpCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", totpDigits, code%1000000), nil
+}
+
+//validateTOTP check code against secret allowing one step of clock drift,
+//returns the matched time step
+func validateTOTP(secret string, code string, t time.Time) (int64, bool) {
+	current := t.Unix() / totpPeriod
+
+	for _, step := range []int64{current, current - 1, current + 1} {
+		expected, err := totpCode(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+//totpProvisioningURI otpauth uri to be rendered as QR code by authenticator apps
+func totpProvisioningURI(secret string, username string) string {
+	issuer := cfg.TOTP.Issuer
+	label := url.PathEscape(fmt.Sprintf("%s:%s", issuer, username))
+
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprintf("%d", totpDigits))
+	query.Set("period", fmt.Sprintf("%d", totpPeriod))
+
+	// authenticator apps expect spaces as %20 rather than +
+	return fmt.Sprintf("otpauth://totp/%s?%s", label, strings.ReplaceAll(query.Encode(), "+", "%20"))
+}
+
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(strings.ToUpper(strings.ReplaceAll(code, "-", ""))))
+	return hex.EncodeToString(sum[:])
+}
+
+//generateRecoveryCodes generate one time recovery codes, returns the codes
+//to show once and the hashes to store
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := []string{}
+	hashes := []string{}
+
+	for i := 0; i < totpRecoveryCodeCount; i++ {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := totpEncoding.EncodeToString(b)
+		codes = append(codes, fmt.Sprintf("%s-%s", code[:4], code[4:]))
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+
+	return codes, hashes, nil
+}
+
+func totpUsedKey(username string, step int64) string {
+	return fmt.Sprintf("totp-used:%s:%d", username, step)
+}
+
+func totpEnrollKey(username string) string {
+	return fmt.Sprintf("totp-enroll:%s", username)
+}
+
+func mfaChallengeKey(token string) string {
+	return fmt.Sprintf("mfa-challenge:%s", token)
+}
+
+func mfaChallengeAttemptsKey(token string) string {
+	return fmt.Sprintf("mfa-challenge-attempts:%s", token)
+}
+
+//verifySecondFactor check a TOTP code or consume a recovery code of admin,
+//a TOTP code is accepted only once
+func verifySecondFactor(admin *Admin, code string, recoveryCode string) (bool, error) {
+	if recoveryCode != "" {
+		hash := hashRecoveryCode(recoveryCode)
+		for i, stored := range admin.RecoveryCodes {
+			if subtle.ConstantTimeCompare([]byte(stored), []byte(hash)) != 1 {
+				continue
+			}
+
+			admin.RecoveryCodes = append(admin.RecoveryCodes[:i:i], admin.RecoveryCodes[i+1:]...)
+			admin.UpdatedAt = time.Now()
+			if err := mgm.Coll(admin).Update(admin); err != nil {
+				return false, err
+			}
+			return true, nil
+		}
+		return false, nil
+	}
+
+	step, ok := validateTOTP(admin.TOTPSecret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+
+	fresh, err := redisClient.SetNX(totpUsedKey(admin.Username, step), 1, 3*totpPeriod*time.Second).Result()
+	if err != nil {
+		return false, err
+	}
+
+	return fresh, nil
+}
+
+//getSecuritySetting get the security setting, defaults when none is stored
+func getSecuritySetting() (*SecuritySetting, error) {
+	setting := &SecuritySetting{
+		RequireTOTPRoles: []string{},
+	}
+
+	err := mgm.Coll(setting).First(bson.M{}, setting)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+
+	return setting, nil
+}
+
+//isTOTPRequired whether the role of admin must use two factor authentication
+func isTOTPRequired(admin *Admin) (bool, error) {
+	setting, err := getSecuritySetting()
+	if err != nil {
+		return false, err
+	}
+
+	for _, role := range setting.RequireTOTPRoles {
+		if role == admin.EffectiveRole() {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+//createMFAChallenge remember that username passed the password step
+func createMFAChallenge(username string) (string, error) {
+	token := uuid.NewV4().String()
+
+	err := redisClient.Set(mfaChallengeKey(token), username, mfaChallengeTTL).Err()
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+//getMFAChallengeAdmin get admin of a pending login challenge
+func getMFAChallengeAdmin(token string) (*Admin, error) {
+	username, err := redisClient.Get(mfaChallengeKey(token)).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	admin := &Admin{}
+	err = mgm.Coll(admin).FindOne(
+		mgm.Ctx(),
+		bson.M{
+			"username": username,
+		},
+	).Decode(&admin)
+	if err != nil || !admin.IsActive {
+		return nil, nil
+	}
+
+	return admin, nil
+}
+
+//startTOTPEnrollment create a pending secret that becomes active once a code
+//generated from it is verified
+func startTOTPEnrollment(username string) (string, error) {
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		return "", err
+	}
+
+	err = redisClient.Set(totpEnrollKey(username), secret, totpEnrollTTL).Err()
+	if err != nil {
+		return "", err
+	}
+
+	return secret, nil
+}
+
+//finishTOTPEnrollment verify code against the pending secret and enable two
+//factor authentication, returns the recovery codes or nil on a wrong code
+func finishTOTPEnrollment(admin *Admin, code string) ([]string, error) {
+	secret, err := redisClient.Get(totpEnrollKey(admin.Username)).Result()
+	if err == redis.Nil {
+		return nil, fmt.Errorf("No pending two-factor enrollment")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	step, ok := validateTOTP(secret, code, time.Now())
+	if !ok {
+		return nil, nil
+	}
+
+	// the confirming code is spent like a login code, it can not be replayed
+	// to sign in right after
+	fresh, err := redisClient.SetNX(totpUsedKey(admin.Username, step), 1, 3*totpPeriod*time.Second).Result()
+	if err != nil {
+		return nil, err
+	}
+	if !fresh {
+		return nil, nil
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	admin.TOTPSecret = secret
+	admin.TOTPEnabled = true
+	admin.RecoveryCodes = hashes
+	admin.UpdatedAt = time.Now()
+
+	err = mgm.Coll(admin).Update(admin)
+	if err != nil {
+		return nil, err
+	}
+	redisClient.Del(totpEnrollKey(admin.Username))
+
+	return codes, nil
+}
+
+//loginData response data of a successful login
+func loginData(admin *Admin, token *tokenDetails) map[string]interface{} {
+	return map[string]interface{}{
+		"data": map[string]interface{}{
+			"id":                admin.ID,
+			"username":          admin.Username,
+			"name":              admin.Name,
+			"profile_image_url": admin.ProfileImageURL,
+		},
+		"accessToken":  token.AccessToken,
+		"refreshToken": token.RefreshToken,
+	}
+}
+
+func adminLoginEnrollTOTP(rw http.ResponseWriter, r *http.Request) {
+	result := &HTTPResponse{}
+
+	mapChallenge := &struct {
+		MFAToken string `json:"mfaToken"`
+	}{}
+
+	rules := govalidator.MapData{
+		"mfaToken": []string{"required"},
+	}
+
+	opts := govalidator.Options{
+		Request: r,
+		Data:    mapChallenge,
+		Rules:   rules,
+	}
+
+	v := govalidator.New(opts)
+	if e := v.ValidateJSON(); len(e) != 0 {
+		result.ValidationError = e
+
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	admin, err := getMFAChallengeAdmin(mapChallenge.MFAToken)
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	if admin == nil {
+		unauthorizedResponse(rw, "Login challenge expired")
+		return
+	}
+	if admin.TOTPEnabled {
+		result.ErrorMsg = "Two-factor authentication already enabled"
+		rw.WriteHeader(http.StatusConflict)
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	secret, err := startTOTPEnrollment(admin.Username)
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	result.Data, err = json.Marshal(map[string]string{
+		"secret":          secret,
+		"provisioningUri": totpProvisioningURI(secret, admin.Username),
+	})
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	result.Status = true
+
+	json.NewEncoder(rw).Encode(result)
+	return
+}
+
+func adminLoginVerifyTOTP(rw http.ResponseWriter, r *http.Request) {
+	result := &HTTPResponse{}
+
+	mapChallenge := &struct {
+		MFAToken     string `json:"mfaToken"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recoveryCode"`
+	}{}
+
+	rules := govalidator.MapData{
+		"mfaToken":     []string{"required"},
+		"code":         []string{"digits:6"},
+		"recoveryCode": []string{"between:8,9"},
+	}
+
+	opts := govalidator.Options{
+		Request: r,
+		Data:    mapChallenge,
+		Rules:   rules,
+	}
+
+	v := govalidator.New(opts)
+	if e := v.ValidateJSON(); len(e) != 0 {
+		result.ValidationError = e
+
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	if mapChallenge.Code == "" && mapChallenge.RecoveryCode == "" {
+		result.ValidationError = url.Values{
+			"code": []string{"The code field is required"},
+		}
+
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	attempts, err := incrementWindow(mfaChallengeAttemptsKey(mapChallenge.MFAToken))
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	if attempts > mfaChallengeAttempts {
+		redisClient.Del(mfaChallengeKey(mapChallenge.MFAToken))
+	}
+
+	admin, err := getMFAChallengeAdmin(mapChallenge.MFAToken)
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	if admin == nil {
+		unauthorizedResponse(rw, "Login challenge expired")
+		return
+	}
+
+	var recoveryCodes []string
+	if admin.TOTPEnabled {
+		ok, err := verifySecondFactor(admin, mapChallenge.Code, mapChallenge.RecoveryCode)
+		if err != nil {
+			log.Println(err)
+			result.ErrorMsg = err.Error()
+			json.NewEncoder(rw).Encode(result)
+			return
+		}
+		if !ok {
+			recordLoginFailure(r, admin.Username)
+			unauthorizedResponse(rw, "Invalid two-factor code")
+			return
+		}
+	} else {
+		recoveryCodes, err = finishTOTPEnrollment(admin, mapChallenge.Code)
+		if err != nil {
+			result.ErrorMsg = err.Error()
+			json.NewEncoder(rw).Encode(result)
+			return
+		}
+		if recoveryCodes == nil {
+			recordLoginFailure(r, admin.Username)
+			unauthorizedResponse(rw, "Invalid two-factor code")
+			return
+		}
+	}
+
+	redisClient.Del(mfaChallengeKey(mapChallenge.MFAToken), mfaChallengeAttemptsKey(mapChallenge.MFAToken))
+
+	token, err := createSession(admin.Username, r)
+	if err != nil {
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	data := loginData(admin, token)
+	if recoveryCodes != nil {
+		data["recoveryCodes"] = recoveryCodes
+	}
+
+	result.Data, err = json.Marshal(data)
+	if err != nil {
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	result.Status = true
+
+	json.NewEncoder(rw).Encode(result)
+	return
+}
+
+func enrollTOTP(rw http.ResponseWriter, r *http.Request) {
+	result := &HTTPResponse{}
+
+	admin := adminFromContext(r)
+	if admin.TOTPEnabled {
+		result.ErrorMsg = "Two-factor authentication already enabled"
+		rw.WriteHeader(http.StatusConflict)
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	secret, err := startTOTPEnrollment(admin.Username)
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	result.Data, err = json.Marshal(map[string]string{
+		"secret":          secret,
+		"provisioningUri": totpProvisioningURI(secret, admin.Username),
+	})
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	result.Status = true
+
+	json.NewEncoder(rw).Encode(result)
+	return
+}
+
+func verifyTOTPEnrollment(rw http.ResponseWriter, r *http.Request) {
+	result := &HTTPResponse{}
+
+	mapCode := &struct {
+		Code string `json:"code"`
+	}{}
+
+	rules := govalidator.MapData{
+		"code": []string{"required", "digits:6"},
+	}
+
+	opts := govalidator.Options{
+		Request: r,
+		Data:    mapCode,
+		Rules:   rules,
+	}
+
+	v := govalidator.New(opts)
+	if e := v.ValidateJSON(); len(e) != 0 {
+		result.ValidationError = e
+
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	admin := adminFromContext(r)
+	if admin.TOTPEnabled {
+		result.ErrorMsg = "Two-factor authentication already enabled"
+		rw.WriteHeader(http.StatusConflict)
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	before := *admin
+
+	recoveryCodes, err := finishTOTPEnrollment(admin, mapCode.Code)
+	if err != nil {
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	if recoveryCodes == nil {
+		result.ErrorMsg = "Invalid two-factor code"
+		rw.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	recordAudit(r, "admin.enable_2fa", auditTargetAdmin, admin.ID.Hex(), before, admin)
+
+	result.Data, err = json.Marshal(map[string]interface{}{
+		"recoveryCodes": recoveryCodes,
+	})
+	if err != nil {
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	result.Status = true
+
+	json.NewEncoder(rw).Encode(result)
+	return
+}
+
+func disableTOTP(rw http.ResponseWriter, r *http.Request) {
+	result := &HTTPResponse{}
+
+	mapDisable := &struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}{}
+
+	rules := govalidator.MapData{
+		"password": []string{"required"},
+		"code":     []string{"required", "digits:6"},
+	}
+
+	opts := govalidator.Options{
+		Request: r,
+		Data:    mapDisable,
+		Rules:   rules,
+	}
+
+	v := govalidator.New(opts)
+	if e := v.ValidateJSON(); len(e) != 0 {
+		result.ValidationError = e
+
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	admin := adminFromContext(r)
+	if !admin.TOTPEnabled {
+		result.ErrorMsg = "Two-factor authentication not enabled"
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	required, err := isTOTPRequired(admin)
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	if required {
+		result.ErrorMsg = "Two-factor authentication is required for your role"
+		rw.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	if !checkPasswordHash(mapDisable.Password, admin.Password) {
+		result.ErrorMsg = "Invalid Password"
+		rw.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	ok, err := verifySecondFactor(admin, mapDisable.Code, "")
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	if !ok {
+		result.ErrorMsg = "Invalid two-factor code"
+		rw.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	before := *admin
+
+	admin.TOTPEnabled = false
+	admin.TOTPSecret = ""
+	admin.RecoveryCodes = []string{}
+	admin.UpdatedAt = time.Now()
+
+	err = mgm.Coll(admin).Update(admin)
+	if err != nil {
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	recordAudit(r, "admin.disable_2fa", auditTargetAdmin, admin.ID.Hex(), before, admin)
+
+	result.Status = true
+
+	json.NewEncoder(rw).Encode(result)
+	return
+}
+
+func regenerateRecoveryCodes(rw http.ResponseWriter, r *http.Request) {
+	result := &HTTPResponse{}
+
+	mapCode := &struct {
+		Code string `json:"code"`
+	}{}
+
+	rules := govalidator.MapData{
+		"code": []string{"required", "digits:6"},
+	}
+
+	opts := govalidator.Options{
+		Request: r,
+		Data:    mapCode,
+		Rules:   rules,
+	}
+
+	v := govalidator.New(opts)
+	if e := v.ValidateJSON(); len(e) != 0 {
+		result.ValidationError = e
+
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	admin := adminFromContext(r)
+	if !admin.TOTPEnabled {
+		result.ErrorMsg = "Two-factor authentication not enabled"
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	ok, err := verifySecondFactor(admin, mapCode.Code, "")
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	if !ok {
+		result.ErrorMsg = "Invalid two-factor code"
+		rw.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	admin.RecoveryCodes = hashes
+	admin.UpdatedAt = time.Now()
+
+	err = mgm.Coll(admin).Update(admin)
+	if err != nil {
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	recordAudit(r, "admin.regenerate_recovery_codes", auditTargetAdmin, admin.ID.Hex(), nil, nil)
+
+	result.Data, err = json.Marshal(map[string]interface{}{
+		"recoveryCodes": codes,
+	})
+	if err != nil {
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	result.Status = true
+
+	json.NewEncoder(rw).Encode(result)
+	return
+}
+
+func getTOTPPolicy(rw http.ResponseWriter, r *http.Request) {
+	result := &HTTPResponse{}
+
+	setting, err := getSecuritySetting()
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	result.Data, err = json.Marshal(map[string]interface{}{
+		"roles": setting.RequireTOTPRoles,
+	})
+	if err != nil {
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	result.Status = true
+
+	json.NewEncoder(rw).Encode(result)
+	return
+}
+
+func updateTOTPPolicy(rw http.ResponseWriter, r *http.Request) {
+	result := &HTTPResponse{}
+
+	mapPolicy := &struct {
+		Roles []string `json:"roles"`
+	}{}
+
+	rules := govalidator.MapData{
+		"roles": []string{},
+	}
+
+	opts := govalidator.Options{
+		Request: r,
+		Data:    mapPolicy,
+		Rules:   rules,
+	}
+
+	v := govalidator.New(opts)
+	if e := v.ValidateJSON(); len(e) != 0 {
+		result.ValidationError = e
+
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	roles := []string{}
+	for _, role := range mapPolicy.Roles {
+		if !isAdminRole(role) {
+			result.ValidationError = url.Values{
+				"roles": []string{fmt.Sprintf("The roles field contains unknown role %s", role)},
+			}
+
+			json.NewEncoder(rw).Encode(result)
+			return
+		}
+		roles = append(roles, role)
+	}
+
+	setting, err := getSecuritySetting()
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	before := *setting
+	setting.RequireTOTPRoles = roles
+
+	if setting.ID.IsZero() {
+		err = mgm.Coll(setting).Create(setting)
+	} else {
+		err = mgm.Coll(setting).Update(setting)
+	}
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	recordAudit(r, "security_setting.update_2fa_policy", auditTargetSecuritySetting, setting.ID.Hex(), before, setting)
+
+	result.Data, err = json.Marshal(map[string]interface{}{
+		"roles": setting.RequireTOTPRoles,
+	})
+	if err != nil {
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	result.Status = true
+
+	json.NewEncoder(rw).Encode(result)
+	return
+}
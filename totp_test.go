@@ -0,0 +1,103 @@
+// Copyright (C) 2021 Administrator
+//
+// This file is part of backend.
+//
+// backend is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// backend is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with backend.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+//rfc6238Secret the SHA-1 seed of the RFC 6238 test vectors, "12345678901234567890"
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 appendix B, the vectors are 8 digits and we keep the last 6
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, tt := range tests {
+		code, err := totpCode(rfc6238Secret, tt.unix/totpPeriod)
+		if err != nil {
+			t.Fatalf("totpCode(%d): %v", tt.unix, err)
+		}
+		if code != tt.code {
+			t.Errorf("totpCode(%d) = %s, want %s", tt.unix, code, tt.code)
+		}
+	}
+}
+
+func TestTOTPCodeLowercaseSecret(t *testing.T) {
+	code, err := totpCode(strings.ToLower(rfc6238Secret), 59/totpPeriod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != "287082" {
+		t.Errorf("got %s, want 287082", code)
+	}
+}
+
+func TestTOTPCodeInvalidSecret(t *testing.T) {
+	if _, err := totpCode("not base32!", 1); err == nil {
+		t.Error("expected an error for an invalid secret")
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := now.Unix() / totpPeriod
+
+	codeAt := func(step int64) string {
+		code, err := totpCode(rfc6238Secret, step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return code
+	}
+
+	tests := []struct {
+		name string
+		code string
+		ok   bool
+		step int64
+	}{
+		{"current step", codeAt(current), true, current},
+		{"previous step", codeAt(current - 1), true, current - 1},
+		{"next step", codeAt(current + 1), true, current + 1},
+		{"two steps behind", codeAt(current - 2), false, 0},
+		{"two steps ahead", codeAt(current + 2), false, 0},
+		{"wrong code", "000000", false, 0},
+		{"empty code", "", false, 0},
+	}
+
+	for _, tt := range tests {
+		step, ok := validateTOTP(rfc6238Secret, tt.code, now)
+		if ok != tt.ok || step != tt.step {
+			t.Errorf("%s: validateTOTP = (%d, %v), want (%d, %v)", tt.name, step, ok, tt.step, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,852 @@
+// Copyright (C) 2021 Administrator
+//
+// This file is part of backend.
+//
+// backend is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// backend is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with backend.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/gorilla/mux"
+	"github.com/kamva/mgm/v3"
+	"github.com/thedevsaddam/govalidator"
+	"github.com/ttacon/libphonenumber"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	voteChannelEmail = "email"
+	voteChannelPhone = "phone"
+
+	voteCounted  = "counted"
+	voteFlagged  = "flagged"
+	voteRejected = "rejected"
+
+	//voteFlagBurst the contestant received unusually many votes at once
+	voteFlagBurst = "burst"
+	//voteFlagSharedIP many voters of the contest came from the same ip
+	voteFlagSharedIP = "shared_ip"
+	//voteFlagSharedDevice many voters of the contest used the same device
+	voteFlagSharedDevice = "shared_device"
+
+	voteCodeLength      = 6
+	maxVoteCodeAttempts = 5
+	voteCodeCooldown    = time.Minute
+
+	voteThrottledMsg = "Too many vote requests, try again later"
+
+	auditTargetVote = "vote"
+)
+
+//pendingVote vote waiting for the voter to confirm the code sent to them
+type pendingVote struct {
+	ContestantID string `json:"contestantId"`
+	CodeHash     string `json:"codeHash"`
+	IP           string `json:"ip"`
+	Fingerprint  string `json:"fingerprint"`
+}
+
+func voteCodeKey(contestID primitive.ObjectID, voter string) string {
+	return fmt.Sprintf("vote-code:%s:%s", contestID.Hex(), voter)
+}
+
+func voteCodeAttemptsKey(contestID primitive.ObjectID, voter string) string {
+	return fmt.Sprintf("vote-code-attempts:%s:%s", contestID.Hex(), voter)
+}
+
+func voteCodeCooldownKey(contestID primitive.ObjectID, voter string) string {
+	return fmt.Sprintf("vote-code-cooldown:%s:%s", contestID.Hex(), voter)
+}
+
+func voteRateIPKey(ip string) string {
+	return fmt.Sprintf("vote-rate:ip:%s", ip)
+}
+
+func voteRateDeviceKey(fingerprint string) string {
+	return fmt.Sprintf("vote-rate:device:%s", fingerprint)
+}
+
+func voteBurstKey(contestantID primitive.ObjectID) string {
+	return fmt.Sprintf("vote-burst:%s", contestantID.Hex())
+}
+
+//randomDigits numeric code of length n
+func randomDigits(n int) (string, error) {
+	code := make([]byte, n)
+	for i := range code {
+		d, err := rand.Int(rand.Reader, big.NewInt(10))
+		if err != nil {
+			return "", err
+		}
+		code[i] = byte('0' + d.Int64())
+	}
+	return string(code), nil
+}
+
+//canonicalEmail identity of an email address, plus tags are dropped and so
+//are the dots gmail ignores, so a+1@gmail.com and a.b@gmail.com count as
+//a@gmail.com and ab@gmail.com
+func canonicalEmail(email string) string {
+	email = strings.ToLower(strings.TrimSpace(email))
+
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return email
+	}
+	local, domain := email[:at], email[at+1:]
+
+	if plus := strings.Index(local, "+"); plus > 0 {
+		local = local[:plus]
+	}
+	if domain == "gmail.com" || domain == "googlemail.com" {
+		local = strings.Replace(local, ".", "", -1)
+		domain = "gmail.com"
+	}
+
+	return local + "@" + domain
+}
+
+//normalizeVoter channel and canonical identity of a voter, phones become
+//E.164 so 0812… and +62812… are the same voter, emails go through
+//canonicalEmail
+func normalizeVoter(email string, phone string) (string, string, url.Values) {
+	if (email == "") == (phone == "") {
+		return "", "", url.Values{
+			"email": []string{"Either the email or the phone field is required"},
+		}
+	}
+
+	if email != "" {
+		return voteChannelEmail, canonicalEmail(email), nil
+	}
+
+	num, err := libphonenumber.Parse(phone, "ID")
+	if err != nil {
+		return "", "", url.Values{
+			"phone": []string{"The phone field must be an Indonesian Telephone Number"},
+		}
+	}
+	return voteChannelPhone, libphonenumber.Format(num, libphonenumber.E164), nil
+}
+
+//sendVoteCode deliver a vote code to the voter by email or through the
+//configured OTP gateway, emails go to the address as typed, not its
+//canonical identity. The message names the contestant since a new request
+//replaces the pending vote
+func sendVoteCode(channel string, to string, contest *Contest, contestant *Contestant, code string) {
+	if channel == voteChannelPhone {
+		message := fmt.Sprintf(
+			"%s: your code to vote for \"%s\" by %s is %s, valid for %s. Never share this code.",
+			contest.Name,
+			contestant.Title,
+			contestant.Name,
+			code,
+			cfg.Voting.CodeTTL,
+		)
+		if err := otpSender.Send(to, message); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	body := fmt.Sprintf(
+		"Your code to confirm your vote for \"%s\" by %s in %s is:\n\n"+
+			"%s\n\n"+
+			"It is valid for %s. Only enter it if this is the contestant you picked,\n"+
+			"if you did not vote, ignore this email.\n",
+		contestant.Title,
+		contestant.Name,
+		contest.Name,
+		code,
+		cfg.Voting.CodeTTL,
+	)
+
+	if err := mailer.Send(to, "Confirm your vote", body); err != nil {
+		log.Println(err)
+	}
+}
+
+//isVoteThrottled count a vote request of the client ip and device, true
+//once either exceeds its limit within the request window
+func isVoteThrottled(r *http.Request, fingerprint string) (bool, error) {
+	ipCount, err := incrementWindowFor(voteRateIPKey(getClientIP(r)), cfg.Voting.RequestWindow)
+	if err != nil {
+		return false, err
+	}
+	deviceCount, err := incrementWindowFor(voteRateDeviceKey(fingerprint), cfg.Voting.RequestWindow)
+	if err != nil {
+		return false, err
+	}
+
+	return ipCount > int64(cfg.Voting.MaxRequestsPerIP) || deviceCount > int64(cfg.Voting.MaxRequestsPerDevice), nil
+}
+
+//hasVoted whether voter already has a vote in the contest, whatever its
+//status
+func hasVoted(contestID primitive.ObjectID, voter string) (bool, error) {
+	voted, err := mgm.Coll(&Vote{}).CountDocuments(mgm.Ctx(), bson.M{"contestId": contestID, "voter": voter})
+	if err != nil {
+		return false, err
+	}
+	return voted > 0, nil
+}
+
+func alreadyVotedResponse(rw http.ResponseWriter, result *HTTPResponse) {
+	result.ErrorMsg = "You already voted in this contest"
+
+	rw.WriteHeader(http.StatusConflict)
+	json.NewEncoder(rw).Encode(result)
+}
+
+//ensureVoteIndexes create the unique index that allows one vote per voter
+//and contest
+func ensureVoteIndexes() error {
+	_, err := mgm.Coll(&Vote{}).Indexes().CreateOne(mgm.Ctx(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "contestId", Value: 1}, {Key: "voter", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+//isDuplicateKeyError whether err is a unique index violation
+func isDuplicateKeyError(err error) bool {
+	switch e := err.(type) {
+	case mongo.WriteException:
+		for _, we := range e.WriteErrors {
+			if we.Code == 11000 {
+				return true
+			}
+		}
+	case mongo.CommandError:
+		return e.Code == 11000
+	}
+	return false
+}
+
+//voteFlags fraud heuristics a new vote trips, a vote with flags waits for
+//review instead of counting, fingerprints are supplied by the client so the
+//shared device check only catches voters who do not change theirs
+func voteFlags(contestID primitive.ObjectID, contestantID primitive.ObjectID, ip string, fingerprint string) ([]string, error) {
+	flags := []string{}
+
+	burst, err := incrementWindowFor(voteBurstKey(contestantID), cfg.Voting.BurstWindow)
+	if err != nil {
+		return nil, err
+	}
+	if burst > int64(cfg.Voting.BurstLimit) {
+		flags = append(flags, voteFlagBurst)
+	}
+
+	sameIP, err := mgm.Coll(&Vote{}).CountDocuments(mgm.Ctx(), bson.M{"contestId": contestID, "ip": ip})
+	if err != nil {
+		return nil, err
+	}
+	if sameIP >= int64(cfg.Voting.SharedIPLimit) {
+		flags = append(flags, voteFlagSharedIP)
+	}
+
+	sameDevice, err := mgm.Coll(&Vote{}).CountDocuments(mgm.Ctx(), bson.M{"contestId": contestID, "fingerprint": fingerprint})
+	if err != nil {
+		return nil, err
+	}
+	if sameDevice >= int64(cfg.Voting.SharedDeviceLimit) {
+		flags = append(flags, voteFlagSharedDevice)
+	}
+
+	return flags, nil
+}
+
+//votingContest contest of the request when it takes votes, otherwise the
+//response is written and nil returned
+func votingContest(rw http.ResponseWriter, r *http.Request, result *HTTPResponse) *Contest {
+	contest, err := findContest(mux.Vars(r)["slug"])
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return nil
+	}
+	if contest == nil {
+		result.ErrorMsg = "Data Not Found"
+
+		rw.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(rw).Encode(result)
+		return nil
+	}
+	if contest.IsArchived() {
+		result.ErrorMsg = "Voting is closed"
+
+		rw.WriteHeader(http.StatusConflict)
+		json.NewEncoder(rw).Encode(result)
+		return nil
+	}
+
+	return contest
+}
+
+//requestVote start a vote, a code is sent to the email or phone of the
+//voter which confirms the vote through verifyVote
+func requestVote(rw http.ResponseWriter, r *http.Request) {
+	result := &HTTPResponse{}
+
+	mapVote := &struct {
+		ContestantID string `json:"contestantId"`
+		Email        string `json:"email"`
+		Phone        string `json:"phone"`
+		Fingerprint  string `json:"fingerprint"`
+	}{}
+
+	rules := govalidator.MapData{
+		"contestantId": []string{"required"},
+		"email":        []string{"email"},
+		"phone":        []string{"phone"},
+		"fingerprint":  []string{"required", "between:8,256"},
+	}
+
+	opts := govalidator.Options{
+		Request: r,
+		Data:    mapVote,
+		Rules:   rules,
+	}
+
+	v := govalidator.New(opts)
+	if e := v.ValidateJSON(); len(e) != 0 {
+		result.ValidationError = e
+
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	channel, voter, e := normalizeVoter(mapVote.Email, mapVote.Phone)
+	if len(e) != 0 {
+		result.ValidationError = e
+
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	contest := votingContest(rw, r, result)
+	if contest == nil {
+		return
+	}
+
+	contestant := &Contestant{}
+	id, err := primitive.ObjectIDFromHex(mapVote.ContestantID)
+	if err == nil {
+		err = mgm.Coll(contestant).First(bson.M{
+			"_id":       id,
+			"contestId": contest.ID,
+			"status":    publicContestantFilter(),
+		}, contestant)
+	}
+	if err != nil {
+		result.ValidationError = url.Values{
+			"contestantId": []string{"The contestantId field must be a contestant of the contest"},
+		}
+
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	throttled, err := isVoteThrottled(r, mapVote.Fingerprint)
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	if throttled {
+		logSecurityEvent(r, "vote_throttled", "contest=%s fingerprint=%s", contest.Slug, mapVote.Fingerprint)
+
+		result.ErrorMsg = voteThrottledMsg
+		rw.WriteHeader(http.StatusTooManyRequests)
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	voted, err := hasVoted(contest.ID, voter)
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	if voted {
+		alreadyVotedResponse(rw, result)
+		return
+	}
+
+	fresh, err := redisClient.SetNX(voteCodeCooldownKey(contest.ID, voter), 1, voteCodeCooldown).Result()
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	if !fresh {
+		result.ErrorMsg = "A code was just sent, wait a minute before asking again"
+
+		rw.WriteHeader(http.StatusTooManyRequests)
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	code, err := randomDigits(voteCodeLength)
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	pending, err := json.Marshal(pendingVote{
+		ContestantID: contestant.ID.Hex(),
+		CodeHash:     hashResetToken(code),
+		IP:           getClientIP(r),
+		Fingerprint:  mapVote.Fingerprint,
+	})
+	if err != nil {
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	err = redisClient.Set(voteCodeKey(contest.ID, voter), pending, cfg.Voting.CodeTTL).Err()
+	if err == nil {
+		err = redisClient.Del(voteCodeAttemptsKey(contest.ID, voter)).Err()
+	}
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	to := voter
+	if channel == voteChannelEmail {
+		to = strings.ToLower(strings.TrimSpace(mapVote.Email))
+	}
+	go sendVoteCode(channel, to, contest, contestant, code)
+
+	result.Data, err = json.Marshal(map[string]interface{}{
+		"channel":   channel,
+		"expiresIn": int(cfg.Voting.CodeTTL.Seconds()),
+	})
+	if err != nil {
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	result.Status = true
+
+	json.NewEncoder(rw).Encode(result)
+	return
+}
+
+//verifyVote confirm a vote with the code sent to the voter, the vote counts
+//right away unless a fraud heuristic holds it for review
+func verifyVote(rw http.ResponseWriter, r *http.Request) {
+	result := &HTTPResponse{}
+
+	mapVerify := &struct {
+		Email string `json:"email"`
+		Phone string `json:"phone"`
+		Code  string `json:"code"`
+	}{}
+
+	rules := govalidator.MapData{
+		"email": []string{"email"},
+		"phone": []string{"phone"},
+		"code":  []string{"required", "digits:6"},
+	}
+
+	opts := govalidator.Options{
+		Request: r,
+		Data:    mapVerify,
+		Rules:   rules,
+	}
+
+	v := govalidator.New(opts)
+	if e := v.ValidateJSON(); len(e) != 0 {
+		result.ValidationError = e
+
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	channel, voter, e := normalizeVoter(mapVerify.Email, mapVerify.Phone)
+	if len(e) != 0 {
+		result.ValidationError = e
+
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	contest := votingContest(rw, r, result)
+	if contest == nil {
+		return
+	}
+
+	invalidCode := func() {
+		result.ValidationError = url.Values{
+			"code": []string{"The code is invalid or expired"},
+		}
+		json.NewEncoder(rw).Encode(result)
+	}
+
+	raw, err := redisClient.Get(voteCodeKey(contest.ID, voter)).Result()
+	if err == redis.Nil {
+		invalidCode()
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	pending := &pendingVote{}
+	if err := json.Unmarshal([]byte(raw), pending); err != nil {
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashResetToken(mapVerify.Code)), []byte(pending.CodeHash)) != 1 {
+		attempts, err := incrementWindowFor(voteCodeAttemptsKey(contest.ID, voter), cfg.Voting.CodeTTL)
+		if err != nil {
+			log.Println(err)
+		}
+		if attempts >= maxVoteCodeAttempts {
+			redisClient.Del(voteCodeKey(contest.ID, voter), voteCodeAttemptsKey(contest.ID, voter))
+			logSecurityEvent(r, "vote_code_exhausted", "contest=%s voter=%s", contest.Slug, voter)
+		}
+
+		invalidCode()
+		return
+	}
+
+	// only the request that actually deletes the code may use it
+	deleted, err := redisClient.Del(voteCodeKey(contest.ID, voter)).Result()
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	if deleted == 0 {
+		invalidCode()
+		return
+	}
+	redisClient.Del(voteCodeAttemptsKey(contest.ID, voter))
+
+	contestantID, err := primitive.ObjectIDFromHex(pending.ContestantID)
+	if err != nil {
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	// several codes may have been requested before the first vote landed
+	voted, err := hasVoted(contest.ID, voter)
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	if voted {
+		alreadyVotedResponse(rw, result)
+		return
+	}
+
+	flags, err := voteFlags(contest.ID, contestantID, pending.IP, pending.Fingerprint)
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	status := voteCounted
+	if len(flags) != 0 {
+		status = voteFlagged
+		logSecurityEvent(r, "vote_flagged", "contest=%s voter=%s flags=%s", contest.Slug, voter, strings.Join(flags, ","))
+	}
+
+	vote := &Vote{
+		ContestID:    contest.ID,
+		ContestantID: contestantID,
+		Channel:      channel,
+		Voter:        voter,
+		IP:           pending.IP,
+		Fingerprint:  pending.Fingerprint,
+		UserAgent:    r.UserAgent(),
+		Status:       status,
+		Flags:        flags,
+	}
+
+	// the unique index settles concurrent verifies of the same voter
+	err = mgm.Coll(vote).Create(vote)
+	if isDuplicateKeyError(err) {
+		alreadyVotedResponse(rw, result)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	if vote.Status == voteCounted {
+		countVoteOnLeaderboard(vote.ContestID, vote.ContestantID)
+	}
+
+	// flags are kept from the voter so they can not learn the heuristics
+	result.Data, err = json.Marshal(map[string]interface{}{
+		"contestantId": vote.ContestantID,
+		"counted":      vote.Status == voteCounted,
+	})
+	if err != nil {
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	result.Status = true
+
+	json.NewEncoder(rw).Encode(result)
+	return
+}
+
+//getVoteReviewQueue flagged votes of a contest, oldest first
+func getVoteReviewQueue(rw http.ResponseWriter, r *http.Request) {
+	result := &HTTPResponse{}
+
+	contest := contestFromVars(rw, r, result)
+	if contest == nil {
+		return
+	}
+
+	query := r.URL.Query()
+
+	limit := 20
+	page := 1
+	if i, e := strconv.Atoi(query.Get("limit")); e == nil && i >= 1 && i <= 100 {
+		limit = i
+	}
+	if i, e := strconv.Atoi(query.Get("page")); e == nil && i >= 1 {
+		page = i
+	}
+
+	filter := bson.M{"contestId": contest.ID, "status": voteFlagged}
+	if flag := query.Get("flag"); flag != "" {
+		filter["flags"] = flag
+	}
+
+	votes := []Vote{}
+
+	findOptions := &options.FindOptions{}
+	findOptions.SetSort(bson.M{"created_at": 1})
+	findOptions.SetLimit(int64(limit))
+	findOptions.SetSkip(int64(page*limit - limit))
+
+	err := mgm.Coll(&Vote{}).SimpleFind(&votes, filter, findOptions)
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	total, err := mgm.Coll(&Vote{}).CountDocuments(mgm.Ctx(), filter)
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	result.Data, err = json.Marshal(map[string]interface{}{
+		"data":  votes,
+		"limit": limit,
+		"page":  page,
+		"total": total,
+	})
+	if err != nil {
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	result.Status = true
+
+	json.NewEncoder(rw).Encode(result)
+	return
+}
+
+//reviewVote count or reject a flagged vote
+func reviewVote(rw http.ResponseWriter, r *http.Request) {
+	result := &HTTPResponse{}
+
+	mapReview := &struct {
+		Decision string `json:"decision"`
+	}{}
+
+	rules := govalidator.MapData{
+		"decision": []string{"required", "in:" + voteCounted + "," + voteRejected},
+	}
+
+	opts := govalidator.Options{
+		Request: r,
+		Data:    mapReview,
+		Rules:   rules,
+	}
+
+	v := govalidator.New(opts)
+	if e := v.ValidateJSON(); len(e) != 0 {
+		result.ValidationError = e
+
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	vote := &Vote{}
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err == nil {
+		err = mgm.Coll(vote).FindByID(id, vote)
+	}
+	if err != nil {
+		result.ErrorMsg = "Data Not Found"
+
+		rw.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	if vote.Status != voteFlagged {
+		result.ErrorMsg = "Only flagged votes can be reviewed"
+
+		rw.WriteHeader(http.StatusConflict)
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	before := *vote
+	now := time.Now()
+	vote.Status = mapReview.Decision
+	vote.ReviewedBy = auditActor(r)
+	vote.ReviewedAt = &now
+
+	err = mgm.Coll(vote).Update(vote)
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	recordAudit(r, "vote.review", auditTargetVote, vote.ID.Hex(), before, vote)
+
+	if vote.Status == voteCounted {
+		countVoteOnLeaderboard(vote.ContestID, vote.ContestantID)
+	}
+
+	result.Data, err = json.Marshal(vote)
+	if err != nil {
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	result.Status = true
+
+	json.NewEncoder(rw).Encode(result)
+	return
+}
+
+//getVoteTally number of votes of every contestant of a contest by status
+func getVoteTally(rw http.ResponseWriter, r *http.Request) {
+	result := &HTTPResponse{}
+
+	contest := contestFromVars(rw, r, result)
+	if contest == nil {
+		return
+	}
+
+	cursor, err := mgm.Coll(&Vote{}).Aggregate(mgm.Ctx(), []bson.M{
+		{"$match": bson.M{"contestId": contest.ID}},
+		{"$group": bson.M{
+			"_id":   bson.M{"contestantId": "$contestantId", "status": "$status"},
+			"count": bson.M{"$sum": 1},
+		}},
+	})
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	groups := []struct {
+		ID struct {
+			ContestantID primitive.ObjectID `bson:"contestantId"`
+			Status       string             `bson:"status"`
+		} `bson:"_id"`
+		Count int `bson:"count"`
+	}{}
+	if err := cursor.All(mgm.Ctx(), &groups); err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	tally := map[string]map[string]int{}
+	for _, group := range groups {
+		contestantID := group.ID.ContestantID.Hex()
+		if tally[contestantID] == nil {
+			tally[contestantID] = map[string]int{
+				voteCounted:  0,
+				voteFlagged:  0,
+				voteRejected: 0,
+			}
+		}
+		tally[contestantID][group.ID.Status] = group.Count
+	}
+
+	result.Data, err = json.Marshal(tally)
+	if err != nil {
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	result.Status = true
+
+	json.NewEncoder(rw).Encode(result)
+	return
+}
@@ -0,0 +1,259 @@
+// Copyright (C) 2021 Administrator
+//
+// This file is part of backend.
+//
+// backend is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// backend is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with backend.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/kamva/mgm/v3"
+	"github.com/thedevsaddam/govalidator"
+)
+
+const (
+	windowStateUnset    = "unset"
+	windowStateUpcoming = "upcoming"
+	windowStateOpen     = "open"
+	windowStateGrace    = "grace"
+	windowStateClosed   = "closed"
+
+	//windowTimeLayout layout of window times given without an offset, they
+	//are read in the contest time zone
+	windowTimeLayout = "2006-01-02 15:04"
+	//windowDisplayLayout layout of window times in error messages
+	windowDisplayLayout = "2 January 2006 15:04 MST"
+
+	maxGracePeriodMinutes = 7 * 24 * 60
+)
+
+//contestLocation time zone submission windows are set and shown in
+var contestLocation = time.UTC
+
+//AcceptsUntil last moment an upload is accepted, the close time plus the
+//grace period
+func (window *SubmissionWindow) AcceptsUntil() time.Time {
+	return window.ClosesAt.Add(time.Duration(window.GracePeriodMinutes) * time.Minute)
+}
+
+//State where t falls in the window
+func (window *SubmissionWindow) State(t time.Time) string {
+	switch {
+	case window == nil:
+		return windowStateUnset
+	case t.Before(window.OpensAt):
+		return windowStateUpcoming
+	case t.Before(window.ClosesAt):
+		return windowStateOpen
+	case t.Before(window.AcceptsUntil()):
+		return windowStateGrace
+	}
+	return windowStateClosed
+}
+
+//AcceptsUploads whether an upload made at t is accepted, a contest without
+//a window accepts uploads until it is archived
+func (window *SubmissionWindow) AcceptsUploads(t time.Time) bool {
+	switch window.State(t) {
+	case windowStateUnset, windowStateOpen, windowStateGrace:
+		return true
+	}
+	return false
+}
+
+//windowError message telling why an upload made at t is rejected
+func (window *SubmissionWindow) windowError(t time.Time) string {
+	if window.State(t) == windowStateUpcoming {
+		return fmt.Sprintf("Registration opens at %s", window.OpensAt.In(contestLocation).Format(windowDisplayLayout))
+	}
+	return fmt.Sprintf("Registration closed at %s", window.ClosesAt.In(contestLocation).Format(windowDisplayLayout))
+}
+
+//parseWindowTime read an RFC 3339 time or a time without offset in the
+//contest time zone
+func parseWindowTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation(windowTimeLayout, value, contestLocation)
+}
+
+//parseSubmissionWindow build a window from request fields, errors are
+//returned the same way govalidator does
+func parseSubmissionWindow(opensAt string, closesAt string, gracePeriodMinutes int) (*SubmissionWindow, url.Values) {
+	errs := url.Values{}
+
+	opens, err := parseWindowTime(opensAt)
+	if err != nil {
+		errs.Add("opensAt", fmt.Sprintf("The opensAt field must be an RFC 3339 time or %s", windowTimeLayout))
+	}
+	closes, err := parseWindowTime(closesAt)
+	if err != nil {
+		errs.Add("closesAt", fmt.Sprintf("The closesAt field must be an RFC 3339 time or %s", windowTimeLayout))
+	}
+	if len(errs) == 0 && !closes.After(opens) {
+		errs.Add("closesAt", "The closesAt field must be after opensAt")
+	}
+	if gracePeriodMinutes < 0 || gracePeriodMinutes > maxGracePeriodMinutes {
+		errs.Add("gracePeriodMinutes", fmt.Sprintf("The gracePeriodMinutes field must be between 0 and %d", maxGracePeriodMinutes))
+	}
+	if len(errs) != 0 {
+		return nil, errs
+	}
+
+	return &SubmissionWindow{
+		OpensAt:            opens.UTC(),
+		ClosesAt:           closes.UTC(),
+		GracePeriodMinutes: gracePeriodMinutes,
+	}, nil
+}
+
+func updateContestWindow(rw http.ResponseWriter, r *http.Request) {
+	result := &HTTPResponse{}
+
+	mapWindow := &struct {
+		OpensAt            string `json:"opensAt"`
+		ClosesAt           string `json:"closesAt"`
+		GracePeriodMinutes int    `json:"gracePeriodMinutes"`
+	}{}
+
+	rules := govalidator.MapData{
+		"opensAt":            []string{"required"},
+		"closesAt":           []string{"required"},
+		"gracePeriodMinutes": []string{},
+	}
+
+	opts := govalidator.Options{
+		Request: r,
+		Data:    mapWindow,
+		Rules:   rules,
+	}
+
+	v := govalidator.New(opts)
+	if e := v.ValidateJSON(); len(e) != 0 {
+		result.ValidationError = e
+
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	window, e := parseSubmissionWindow(mapWindow.OpensAt, mapWindow.ClosesAt, mapWindow.GracePeriodMinutes)
+	if len(e) != 0 {
+		result.ValidationError = e
+
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	contest, err := findContest(mux.Vars(r)["id"])
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	if contest == nil {
+		result.ErrorMsg = "Data Not Found"
+
+		rw.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	before := *contest
+	contest.Window = window
+
+	err = mgm.Coll(contest).Update(contest)
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	recordAudit(r, "contest.update_window", auditTargetContest, contest.ID.Hex(), before, contest)
+
+	result.Data, err = json.Marshal(contestWindowData(contest, time.Now()))
+	if err != nil {
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	result.Status = true
+
+	json.NewEncoder(rw).Encode(result)
+	return
+}
+
+//contestWindowData window of contest as seen at now, times are shown in
+//the contest time zone and serverTime lets clients correct their clock
+func contestWindowData(contest *Contest, now time.Time) map[string]interface{} {
+	data := map[string]interface{}{
+		"contest":    contest.Slug,
+		"timeZone":   contestLocation.String(),
+		"serverTime": now.In(contestLocation),
+		"state":      contest.Window.State(now),
+		"isOpen":     !contest.IsArchived() && contest.Window.AcceptsUploads(now),
+	}
+
+	if contest.Window != nil {
+		data["opensAt"] = contest.Window.OpensAt.In(contestLocation)
+		data["closesAt"] = contest.Window.ClosesAt.In(contestLocation)
+		data["gracePeriodMinutes"] = contest.Window.GracePeriodMinutes
+		data["acceptsUntil"] = contest.Window.AcceptsUntil().In(contestLocation)
+	}
+	if contest.IsArchived() {
+		data["state"] = windowStateClosed
+	}
+
+	return data
+}
+
+func getContestWindow(rw http.ResponseWriter, r *http.Request) {
+	result := &HTTPResponse{}
+
+	contest, err := findContest(mux.Vars(r)["slug"])
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	if contest == nil {
+		result.ErrorMsg = "Data Not Found"
+
+		rw.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	result.Data, err = json.Marshal(contestWindowData(contest, time.Now()))
+	if err != nil {
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	result.Status = true
+
+	json.NewEncoder(rw).Encode(result)
+	return
+}
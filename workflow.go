@@ -0,0 +1,335 @@
+// Copyright (C) 2021 Administrator
+//
+// This file is part of backend.
+//
+// backend is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// backend is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with backend.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/kamva/mgm/v3"
+	"github.com/thedevsaddam/govalidator"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	contestantSubmitted   = "submitted"
+	contestantUnderReview = "under_review"
+	contestantApproved    = "approved"
+	contestantRejected    = "rejected"
+	contestantFinalist    = "finalist"
+	contestantWinner      = "winner"
+	//contestantExpired the email was not verified in time, nothing moves a
+	//contestant out of it
+	contestantExpired = "expired"
+)
+
+var contestantStates = []string{
+	contestantSubmitted,
+	contestantUnderReview,
+	contestantApproved,
+	contestantRejected,
+	contestantFinalist,
+	contestantWinner,
+	contestantExpired,
+}
+
+//publicContestantStates states a contestant has to be in to show up on
+//public endpoints
+var publicContestantStates = []string{contestantApproved, contestantFinalist, contestantWinner}
+
+//stateTransition a state a contestant may move to and the roles allowed to
+//move it there
+type stateTransition struct {
+	To    string
+	Roles []string
+}
+
+//contestantTransitions allowed moves out of every state, admins review
+//submissions while picking finalists and winners is left to superadmins
+var contestantTransitions = map[string][]stateTransition{
+	contestantSubmitted: {
+		{To: contestantUnderReview, Roles: []string{adminRoleAdmin, adminRoleSuperadmin}},
+	},
+	contestantUnderReview: {
+		{To: contestantApproved, Roles: []string{adminRoleAdmin, adminRoleSuperadmin}},
+		{To: contestantRejected, Roles: []string{adminRoleAdmin, adminRoleSuperadmin}},
+	},
+	contestantApproved: {
+		{To: contestantFinalist, Roles: []string{adminRoleSuperadmin}},
+	},
+	contestantFinalist: {
+		{To: contestantWinner, Roles: []string{adminRoleSuperadmin}},
+	},
+}
+
+func isContestantState(state string) bool {
+	for _, s := range contestantStates {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
+
+func isPublicContestantState(state string) bool {
+	for _, s := range publicContestantStates {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
+
+//State workflow state of the contestant, contestants stored before states
+//existed count as submitted
+func (contestant *Contestant) State() string {
+	if contestant.Status == "" {
+		return contestantSubmitted
+	}
+	return contestant.Status
+}
+
+//contestantStateFilter filter matching contestants in state
+func contestantStateFilter(state string) interface{} {
+	if state == contestantSubmitted {
+		return bson.M{"$in": bson.A{contestantSubmitted, nil}}
+	}
+	return state
+}
+
+//publicContestantFilter filter matching contestants public endpoints may show
+func publicContestantFilter() interface{} {
+	return bson.M{"$in": publicContestantStates}
+}
+
+//droppedContestantStates states that take a contestant out of judging
+var droppedContestantStates = []string{contestantRejected, contestantExpired}
+
+//IsDropped whether the contestant was taken out of judging
+func (contestant *Contestant) IsDropped() bool {
+	state := contestant.State()
+	for _, s := range droppedContestantStates {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
+
+//judgedContestantFilter filter matching the states of contestants that are
+//still judged
+func judgedContestantFilter() interface{} {
+	return bson.M{"$nin": droppedContestantStates}
+}
+
+//publicContestant contestant as shown on public endpoints, personal data is
+//left out
+type publicContestant struct {
+	ID        primitive.ObjectID `json:"id"`
+	ContestID primitive.ObjectID `json:"contestId"`
+	Name      string             `json:"name"`
+	School    string             `json:"school"`
+	Title     string             `json:"title"`
+	Video     *ContestantVideo   `json:"video"`
+	Status    string             `json:"status"`
+}
+
+func newPublicContestant(contestant *Contestant) *publicContestant {
+	return &publicContestant{
+		ID:        contestant.ID,
+		ContestID: contestant.ContestID,
+		Name:      contestant.Name,
+		School:    contestant.School,
+		Title:     contestant.Title,
+		Video:     contestant.Video,
+		Status:    contestant.State(),
+	}
+}
+
+//checkTransition whether role may move a contestant from one state to
+//another, exists is false when no role may
+func checkTransition(from string, to string, role string) (allowed bool, exists bool) {
+	for _, transition := range contestantTransitions[from] {
+		if transition.To != to {
+			continue
+		}
+		for _, r := range transition.Roles {
+			if r == role {
+				return true, true
+			}
+		}
+		return false, true
+	}
+	return false, false
+}
+
+//transitionContestant move a contestant to another workflow state
+func transitionContestant(rw http.ResponseWriter, r *http.Request) {
+	result := &HTTPResponse{}
+
+	mapTransition := &struct {
+		State  string `json:"state"`
+		Reason string `json:"reason"`
+	}{}
+
+	rules := govalidator.MapData{
+		"state":  []string{"required", "in:" + strings.Join(contestantStates, ",")},
+		"reason": []string{"between:3,500"},
+	}
+
+	opts := govalidator.Options{
+		Request: r,
+		Data:    mapTransition,
+		Rules:   rules,
+	}
+
+	v := govalidator.New(opts)
+	if e := v.ValidateJSON(); len(e) != 0 {
+		result.ValidationError = e
+
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	if mapTransition.State == contestantRejected && strings.TrimSpace(mapTransition.Reason) == "" {
+		result.ValidationError = url.Values{
+			"reason": []string{"The reason field is required when rejecting"},
+		}
+
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	contestant := &Contestant{}
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err == nil {
+		err = mgm.Coll(contestant).FindByID(id, contestant)
+	}
+	if err != nil {
+		result.ErrorMsg = "Data Not Found"
+
+		rw.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	from := contestant.State()
+
+	admin := adminFromContext(r)
+
+	allowed, exists := checkTransition(from, mapTransition.State, admin.EffectiveRole())
+	if !exists {
+		result.ErrorMsg = fmt.Sprintf("A contestant can not move from %s to %s", from, mapTransition.State)
+
+		rw.WriteHeader(http.StatusConflict)
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	if !allowed {
+		forbiddenResponse(rw)
+		return
+	}
+
+	before := *contestant
+	now := time.Now()
+
+	reason := ""
+	if mapTransition.State == contestantRejected {
+		reason = mapTransition.Reason
+	}
+
+	transition := ContestantTransition{
+		From:   from,
+		To:     mapTransition.State,
+		Reason: mapTransition.Reason,
+		By:     admin.Username,
+		At:     now,
+	}
+
+	// only moves the contestant when it is still in the state checked above,
+	// an update pipeline since statusHistory may be stored as null which
+	// $push refuses
+	res, err := mgm.Coll(contestant).UpdateOne(mgm.Ctx(), bson.M{
+		"_id":    contestant.ID,
+		"status": contestantStateFilter(from),
+	}, bson.A{
+		bson.M{"$set": bson.M{
+			"status":          mapTransition.State,
+			"statusReason":    reason,
+			"statusChangedAt": now,
+			"updated_at":      now,
+			"statusHistory": bson.M{"$concatArrays": bson.A{
+				bson.M{"$ifNull": bson.A{"$statusHistory", bson.A{}}},
+				bson.M{"$literal": bson.A{transition}},
+			}},
+		}},
+	})
+	if err != nil {
+		log.Println(err)
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	if res.MatchedCount == 0 {
+		result.ErrorMsg = "Contestant was moved by someone else, reload and try again"
+
+		rw.WriteHeader(http.StatusConflict)
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+
+	contestant.Status = mapTransition.State
+	contestant.StatusReason = reason
+	contestant.StatusChangedAt = &now
+	contestant.UpdatedAt = now
+	contestant.StatusHistory = append(contestant.StatusHistory, transition)
+
+	recordAudit(r, "contestant.transition", auditTargetContestant, contestant.ID.Hex(), before, contestant)
+
+	if contestant.Status == contestantApproved || contestant.Status == contestantRejected {
+		if err := sendReviewDecision(contestant); err != nil {
+			log.Println(err)
+		}
+	}
+
+	// leaderboards only rank public contestants, and scores of dropped
+	// contestants leave the judge means z-scores use
+	if isPublicContestantState(from) != isPublicContestantState(contestant.Status) {
+		clearLeaderboard(contestant.ContestID, leaderboardScores)
+		clearLeaderboard(contestant.ContestID, leaderboardVotes)
+	} else if before.IsDropped() != contestant.IsDropped() {
+		clearLeaderboard(contestant.ContestID, leaderboardScores)
+	}
+
+	result.Data, err = json.Marshal(contestant)
+	if err != nil {
+		result.ErrorMsg = err.Error()
+		json.NewEncoder(rw).Encode(result)
+		return
+	}
+	result.Status = true
+
+	json.NewEncoder(rw).Encode(result)
+	return
+}